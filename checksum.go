@@ -0,0 +1,111 @@
+package pushr
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"strings"
+)
+
+// ChecksumError is returned by Download if the downloaded file does not match the digest announced by the server.
+type ChecksumError struct {
+	Algorithm string
+	Expected  string
+	Actual    string
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("Checksum mismatch (%s): expected %s, got %s", e.Algorithm, e.Expected, e.Actual)
+}
+
+var digestAlgorithms = map[string]func() hash.Hash{
+	"SHA-256": sha256.New,
+	"SHA-512": sha512.New,
+}
+
+// DigestHeader builds the value of a Digest header (RFC 3230) from hex encoded checksums.
+// Empty checksums are omitted.
+func DigestHeader(sha256Hex string, sha512Hex string) string {
+	var parts []string
+	for _, d := range []struct {
+		algorithm string
+		hex       string
+	}{{"SHA-256", sha256Hex}, {"SHA-512", sha512Hex}} {
+		if d.hex == "" {
+			continue
+		}
+		b, err := hex.DecodeString(d.hex)
+		if err != nil {
+			continue
+		}
+		parts = append(parts, d.algorithm+"="+base64.StdEncoding.EncodeToString(b))
+	}
+	return strings.Join(parts, ",")
+}
+
+// ParseDigest parses the value of a Digest header (RFC 3230) into hex encoded checksums keyed by algorithm.
+// Only SHA-256 and SHA-512 are supported, other algorithms and invalid values are ignored.
+func ParseDigest(header string) map[string]string {
+	sums := make(map[string]string)
+	for _, part := range strings.Split(header, ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		algorithm := strings.ToUpper(kv[0])
+		if _, found := digestAlgorithms[algorithm]; !found {
+			continue
+		}
+		sum, err := base64.StdEncoding.DecodeString(kv[1])
+		if err != nil {
+			continue
+		}
+		sums[algorithm] = hex.EncodeToString(sum)
+	}
+	return sums
+}
+
+// digestVerifier hashes everything written to it and compares the result
+// against the digests of a Digest header.
+type digestVerifier struct {
+	expected map[string][]byte
+	hashes   map[string]hash.Hash
+}
+
+func newDigestVerifier(header string) *digestVerifier {
+	v := &digestVerifier{
+		expected: make(map[string][]byte),
+		hashes:   make(map[string]hash.Hash),
+	}
+	for algorithm, sum := range ParseDigest(header) {
+		v.expected[algorithm], _ = hex.DecodeString(sum)
+		v.hashes[algorithm] = digestAlgorithms[algorithm]()
+	}
+	return v
+}
+
+func (v *digestVerifier) Write(p []byte) (int, error) {
+	for _, h := range v.hashes {
+		h.Write(p)
+	}
+	return len(p), nil
+}
+
+// Verify returns a *ChecksumError if any of the announced digests does not match.
+func (v *digestVerifier) Verify() error {
+	for algorithm, expected := range v.expected {
+		actual := v.hashes[algorithm].Sum(nil)
+		if !bytes.Equal(expected, actual) {
+			return &ChecksumError{
+				Algorithm: algorithm,
+				Expected:  hex.EncodeToString(expected),
+				Actual:    hex.EncodeToString(actual),
+			}
+		}
+	}
+	return nil
+}
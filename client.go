@@ -2,32 +2,223 @@ package pushr
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"github.com/blang/semver"
 	"io"
+	"io/ioutil"
 	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
+	"runtime"
 	"sort"
+	"strconv"
 	"strings"
+	"time"
 )
 
+var (
+	ErrBadRequest   = errors.New("Bad request")
+	ErrUnauthorized = errors.New("Unauthorized")
+	ErrForbidden    = errors.New("Forbidden")
+	ErrNotFound     = errors.New("Not found")
+	ErrConflict     = errors.New("Version already exists")
+	ErrNoVersion    = errors.New("No version in this channel available")
+)
+
+// StatusError is returned by all client methods if the server responds with an unexpected status code.
+// It matches ErrBadRequest, ErrUnauthorized, ErrForbidden, ErrNotFound and ErrConflict using errors.Is.
+type StatusError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *StatusError) Error() string {
+	if e.Body == "" {
+		return fmt.Sprintf("Unexpected status %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+	}
+	return fmt.Sprintf("Unexpected status %d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Body)
+}
+
+func (e *StatusError) Is(target error) bool {
+	switch target {
+	case ErrBadRequest:
+		return e.StatusCode == http.StatusBadRequest
+	case ErrUnauthorized:
+		return e.StatusCode == http.StatusUnauthorized
+	case ErrForbidden:
+		return e.StatusCode == http.StatusForbidden
+	case ErrNotFound:
+		return e.StatusCode == http.StatusNotFound
+	case ErrConflict:
+		return e.StatusCode == http.StatusConflict
+	}
+	return false
+}
+
+func newStatusError(resp *http.Response) error {
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+	return &StatusError{
+		StatusCode: resp.StatusCode,
+		Body:       strings.TrimSpace(string(body)),
+	}
+}
+
 type Client struct {
 	host       string
 	readToken  string
 	writeToken string
+	httpClient *http.Client
+	userAgent  string
+	timeout    time.Duration
+
+	chunkThreshold int64         // Minimum size of uploads using resumable upload sessions, disabled if not positive
+	chunkSize      int64         // Size of a chunk of an upload session
+	retryDelay     time.Duration // Delay before resuming a failed chunk or reconnecting a watch
+
+	signingKey ed25519.PrivateKey  // Key signing uploads, if set
+	publicKeys []ed25519.PublicKey // Keys trusted to sign downloads, downloads are not verified if empty
+
+	rootCAs     *x509.CertPool    // Roots verifying the server certificate, if set
+	clientCerts []tls.Certificate // Certificates presented to the server
+
+	err error // Invalid configuration, returned by every request
+}
+
+// Option configures a Client.
+type Option func(*Client)
+
+// WithHTTPClient sets the http.Client used for all requests, e.g. to configure proxies or custom transports.
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(c *Client) {
+		c.httpClient = httpClient
+	}
+}
+
+// WithUserAgent sets the User-Agent header sent with every request.
+func WithUserAgent(userAgent string) Option {
+	return func(c *Client) {
+		c.userAgent = userAgent
+	}
 }
 
-func NewClient(host, readToken string, writeToken string) *Client {
-	return &Client{
-		host:       host,
-		readToken:  readToken,
-		writeToken: writeToken,
+// WithTimeout limits the duration of every call, including reading the response body.
+// A zero timeout means no limit.
+func WithTimeout(timeout time.Duration) Option {
+	return func(c *Client) {
+		c.timeout = timeout
 	}
 }
 
+// WithChunkedUpload configures resumable uploads: uploads of known size of at least threshold bytes
+// are sent in chunks of chunkSize bytes, resuming interrupted chunks.
+// A threshold of zero disables resumable uploads.
+func WithChunkedUpload(threshold int64, chunkSize int64) Option {
+	return func(c *Client) {
+		c.chunkThreshold = threshold
+		if chunkSize > 0 {
+			c.chunkSize = chunkSize
+		}
+	}
+}
+
+// WithRootCAs verifies the server certificate against pool instead of the system roots.
+// A transport set by WithHTTPClient must be an *http.Transport, otherwise every request fails.
+func WithRootCAs(pool *x509.CertPool) Option {
+	return func(c *Client) {
+		c.rootCAs = pool
+	}
+}
+
+// WithClientCertificate presents cert to servers verifying client certificates,
+// which authenticates the client without token.
+// A transport set by WithHTTPClient must be an *http.Transport, otherwise every request fails.
+func WithClientCertificate(cert tls.Certificate) Option {
+	return func(c *Client) {
+		c.clientCerts = append(c.clientCerts, cert)
+	}
+}
+
+// NewClient returns a client of the server at host.
+// Options which can not be applied, like TLS options with a custom transport, make every request fail.
+func NewClient(host, readToken string, writeToken string, opts ...Option) *Client {
+	c := &Client{
+		host:           host,
+		readToken:      readToken,
+		writeToken:     writeToken,
+		httpClient:     &http.Client{},
+		userAgent:      "pushr-client",
+		chunkThreshold: DefaultChunkThreshold,
+		chunkSize:      DefaultChunkSize,
+		retryDelay:     time.Second,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.rootCAs != nil || len(c.clientCerts) > 0 {
+		c.err = c.configureTLS()
+	}
+	return c
+}
+
+// configureTLS applies the TLS options to a copy of the http.Client and its transport.
+// Other transports than *http.Transport can not be configured, the options would be ignored.
+func (c *Client) configureTLS() error {
+	var transport *http.Transport
+	switch t := c.httpClient.Transport.(type) {
+	case nil:
+		transport = http.DefaultTransport.(*http.Transport).Clone()
+	case *http.Transport:
+		transport = t.Clone()
+	default:
+		return fmt.Errorf("TLS options need an *http.Transport, got %T", t)
+	}
+	if transport.TLSClientConfig == nil {
+		transport.TLSClientConfig = &tls.Config{}
+	}
+	if c.rootCAs != nil {
+		transport.TLSClientConfig.RootCAs = c.rootCAs
+	}
+	transport.TLSClientConfig.Certificates = append(transport.TLSClientConfig.Certificates, c.clientCerts...)
+	httpClient := *c.httpClient
+	httpClient.Transport = transport
+	c.httpClient = &httpClient
+	return nil
+}
+
 type Release struct {
 	Versions map[string]*Version `json:"versions"`
+
+	// Channels holds the versions promoted into a channel keyed by channel name
+	Channels map[string]*Channel `json:"channels,omitempty"`
+}
+
+// Channel points to the version promoted into a release channel.
+// Version is empty if the pointer was removed.
+type Channel struct {
+	Version  string    `json:"version"`
+	Promoted time.Time `json:"promoted"`
+
+	// History lists all promotions into the channel, oldest first
+	History []*Promotion `json:"history,omitempty"`
+}
+
+// Promotion records a single change of a channel pointer, Version is empty for a removal.
+type Promotion struct {
+	Version  string    `json:"version"`
+	Previous string    `json:"previous,omitempty"`
+	Promoted time.Time `json:"promoted"`
+	Remote   string    `json:"remote,omitempty"`
 }
 
 func NewRelease() *Release {
@@ -37,9 +228,182 @@ func NewRelease() *Release {
 }
 
 type Version struct {
-	ContentType string `json:"contenttype"`
-	Size        int64  `json:"size"`
-	Filename    string `json:"filename"`
+	ContentType string    `json:"contenttype"`
+	Size        int64     `json:"size"`
+	Filename    string    `json:"filename"`
+	SHA256      string    `json:"sha256,omitempty"`
+	SHA512      string    `json:"sha512,omitempty"`
+	Uploaded    time.Time `json:"uploaded"`
+	Notes       string    `json:"notes,omitempty"`
+	Yanked      bool      `json:"yanked,omitempty"`
+	Signature   string    `json:"signature,omitempty"` // Base64 encoded detached signature, see Sign
+
+	// Artifacts holds additional platform specific files keyed by Platform.Key
+	Artifacts map[string]*Artifact `json:"artifacts,omitempty"`
+}
+
+// Platform identifies the target of an artifact by GOOS, GOARCH and an optional free-form variant.
+type Platform struct {
+	OS      string `json:"os"`
+	Arch    string `json:"arch"`
+	Variant string `json:"variant,omitempty"`
+}
+
+// CurrentPlatform returns the platform of the running binary.
+func CurrentPlatform() Platform {
+	return Platform{OS: runtime.GOOS, Arch: runtime.GOARCH}
+}
+
+// Key returns the key of the platform in Version.Artifacts, e.g. linux/amd64 or linux/arm/v7.
+func (p Platform) Key() string {
+	if p.Variant == "" {
+		return p.OS + "/" + p.Arch
+	}
+	return p.OS + "/" + p.Arch + "/" + p.Variant
+}
+
+// Artifact is a platform specific file of a version.
+type Artifact struct {
+	Platform
+	ContentType string    `json:"contenttype"`
+	Size        int64     `json:"size"`
+	Filename    string    `json:"filename"`
+	SHA256      string    `json:"sha256,omitempty"`
+	SHA512      string    `json:"sha512,omitempty"`
+	Uploaded    time.Time `json:"uploaded"`
+	Signature   string    `json:"signature,omitempty"`
+}
+
+// UploadSession is the state of a resumable upload.
+// It is created with the target and the announced size and digest of the file,
+// the server fills in ID, Offset and Expires.
+type UploadSession struct {
+	ID        string    `json:"id,omitempty"`
+	Release   string    `json:"release"`
+	Version   string    `json:"version"`
+	Filename  string    `json:"filename"`
+	Platform  *Platform `json:"platform,omitempty"`
+	Notes     string    `json:"notes,omitempty"`
+	Size      int64     `json:"size"`
+	Digest    string    `json:"digest,omitempty"`
+	Signature string    `json:"signature,omitempty"`
+	Offset    int64     `json:"offset"`
+	Expires   time.Time `json:"expires,omitempty"`
+}
+
+// Scopes of API tokens
+const (
+	ScopeRead   = "read"   // List and download releases
+	ScopeWrite  = "write"  // Upload, yank and promote versions
+	ScopeDelete = "delete" // Delete versions
+	ScopeAdmin  = "admin"  // Manage tokens
+)
+
+// Token is an API token scoped to operations and release name patterns.
+// The secret is only returned once on creation, the server stores its hash.
+type Token struct {
+	Name     string     `json:"name"`
+	Scopes   []string   `json:"scopes"`
+	Releases []string   `json:"releases,omitempty"` // Release name patterns as understood by path.Match, all releases if empty
+	Created  time.Time  `json:"created"`
+	Expires  *time.Time `json:"expires,omitempty"`
+	Secret   string     `json:"token,omitempty"`
+}
+
+// SignedURL is a download link which is valid without token until it expires.
+type SignedURL struct {
+	URL     string    `json:"url"`
+	Expires time.Time `json:"expires"`
+}
+
+// DownloadStats counts the downloads of a version or release.
+// Partial downloads are range requests, e.g. resumed downloads. Channels and Days only count full downloads,
+// channels if downloaded through the latest endpoint of the channel.
+type DownloadStats struct {
+	Full     int64            `json:"full"`
+	Partial  int64            `json:"partial"`
+	Channels map[string]int64 `json:"channels,omitempty"`
+	Days     map[string]int64 `json:"days,omitempty"` // Keyed by UTC date, e.g. 2006-01-02
+}
+
+// ReleaseStats are the download statistics of a release, summed up over all versions.
+type ReleaseStats struct {
+	DownloadStats
+	Versions map[string]*DownloadStats `json:"versions"`
+}
+
+// Types of release events
+const (
+	EventUpload    = "upload"    // A version or platform artifact was uploaded
+	EventDelete    = "delete"    // A version was deleted
+	EventYank      = "yank"      // A version was yanked
+	EventUnyank    = "unyank"    // A yanked version was restored
+	EventPromote   = "promote"   // A version was promoted to a channel
+	EventUnpromote = "unpromote" // The version pointer of a channel was removed, the event carries the previous version
+	EventLatest    = "latest"    // The latest version of a channel changed, sent by event streams of a channel only
+)
+
+// Event is a change of a release, sent to webhooks and event streams.
+type Event struct {
+	ID       string    `json:"id"`
+	Type     string    `json:"type"`
+	Release  string    `json:"release"`
+	Version  string    `json:"version"`
+	Channel  string    `json:"channel,omitempty"`  // Promotions and latest events only
+	Platform string    `json:"platform,omitempty"` // Uploads of platform artifacts only
+	Time     time.Time `json:"time"`
+	Metadata *Version  `json:"metadata,omitempty"` // Metadata of the version after the change, before for deletions
+}
+
+// ResolvedVersion is a version together with its version number, as returned by the latest endpoint.
+type ResolvedVersion struct {
+	Number string `json:"version"`
+	*Version
+}
+
+// Latest returns the latest version available in channel, skipping yanked versions.
+// A version promoted into the channel on the server takes precedence.
+// Otherwise the stable channel (default) contains all versions without prerelease identifier,
+// any other channel all versions whose first prerelease identifier matches the channel plus the stable versions.
+func (r *Release) Latest(channel string) (*Version, string, error) {
+	if channel == "" {
+		channel = "stable"
+	}
+
+	if c, found := r.Channels[channel]; found {
+		if version, found := r.Versions[c.Version]; found && !version.Yanked {
+			return version, c.Version, nil
+		}
+	}
+
+	versions := make([]semver.Version, 0, len(r.Versions))
+	for versionStr, version := range r.Versions {
+		if version.Yanked {
+			continue
+		}
+		v, err := semver.New(versionStr)
+		if err == nil {
+			versions = append(versions, v)
+		}
+	}
+
+	sort.Sort(ByVersion(versions))
+
+	for i := len(versions) - 1; i >= 0; i-- {
+		v := versions[i]
+		if channel == "stable" {
+			if len(v.Pre) == 0 {
+				return r.Versions[v.String()], v.String(), nil
+			}
+		} else {
+			// Accept stable release if it's the latest version, otherwise search for specific channel
+			if len(v.Pre) == 0 || (len(v.Pre) > 0 && v.Pre[0].String() == channel) {
+				return r.Versions[v.String()], v.String(), nil
+			}
+		}
+	}
+
+	return nil, "", ErrNoVersion
 }
 
 type ByVersion []semver.Version
@@ -61,18 +425,26 @@ func NewVersion() *Version {
 }
 
 func (c *Client) Release(release string) (*Release, error) {
-	req, err := http.NewRequest("GET", c.cleanHost()+"/releases/"+release, nil)
+	return c.ReleaseContext(context.Background(), release)
+}
+
+// ReleaseContext is like Release but aborts the request if ctx is done.
+func (c *Client) ReleaseContext(ctx context.Context, release string) (*Release, error) {
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+	req, err := c.newRequest(ctx, "GET", "/releases/"+release, c.readToken, nil)
 	if err != nil {
 		return nil, err
 	}
-	req.Header.Set("X-PUSHR-TOKEN", c.readToken)
 	req.Header.Set("Accept", "application/json")
-	client := &http.Client{}
-	binresp, err := client.Do(req)
+	binresp, err := c.httpClient.Do(req)
 	if err != nil {
 		return nil, err
 	}
 	defer binresp.Body.Close()
+	if binresp.StatusCode != http.StatusOK {
+		return nil, newStatusError(binresp)
+	}
 	r := bufio.NewReader(binresp.Body)
 	var rel Release
 	err = json.NewDecoder(r).Decode(&rel)
@@ -83,55 +455,83 @@ func (c *Client) Release(release string) (*Release, error) {
 	return &rel, nil
 }
 
+// LatestVersion returns the latest version of release in channel, resolved by the server.
+// The error matches ErrNotFound if the release is unknown or the channel has no version.
 func (c *Client) LatestVersion(release string, channel string) (*Version, string, error) {
-	r, err := c.Release(release)
+	return c.LatestVersionContext(context.Background(), release, channel)
+}
+
+// LatestVersionContext is like LatestVersion but aborts the request if ctx is done.
+func (c *Client) LatestVersionContext(ctx context.Context, release string, channel string) (*Version, string, error) {
+	resolved, err := c.resolveLatest(ctx, release, channel)
+	if err == nil {
+		return resolved.Version, resolved.Number, nil
+	}
+	// Older servers have no latest endpoint, resolve locally. Their router answers without error message,
+	// unlike the endpoint for an unknown release or a channel without version.
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) || !(statusErr.StatusCode == http.StatusMethodNotAllowed || statusErr.StatusCode == http.StatusNotFound && statusErr.Body == "") {
+		return nil, "", err
+	}
+	r, err := c.ReleaseContext(ctx, release)
 	if err != nil {
 		return nil, "", err
 	}
-	if channel == "" {
-		channel = "stable"
+	version, versionStr, err := r.Latest(channel)
+	if err == ErrNoVersion {
+		return nil, "", &StatusError{StatusCode: http.StatusNotFound, Body: err.Error()}
 	}
+	return version, versionStr, err
+}
 
-	versions := make([]semver.Version, 0, len(r.Versions))
-	for versionStr := range r.Versions {
-		v, err := semver.New(versionStr)
-		if err == nil {
-			versions = append(versions, v)
-		}
+func (c *Client) resolveLatest(ctx context.Context, release string, channel string) (*ResolvedVersion, error) {
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+	req, err := c.newRequest(ctx, "GET", "/releases/"+release+"/latest?channel="+url.QueryEscape(channel), c.readToken, nil)
+	if err != nil {
+		return nil, err
 	}
-
-	sort.Sort(ByVersion(versions))
-
-	for i := len(versions) - 1; i >= 0; i-- {
-		v := versions[i]
-		if channel == "stable" {
-			if len(v.Pre) == 0 {
-				return r.Versions[v.String()], v.String(), nil
-			}
-		} else {
-			// Accept stable release if it's the latest version, otherwise search for specific channel
-			if len(v.Pre) == 0 || (len(v.Pre) > 0 && v.Pre[0].String() == channel) {
-				return r.Versions[v.String()], v.String(), nil
-			}
-		}
+	req.Header.Set("Accept", "application/json")
+	binresp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
 	}
-
-	return nil, "", errors.New("No version in this channel available")
+	defer binresp.Body.Close()
+	if binresp.StatusCode != http.StatusOK {
+		return nil, newStatusError(binresp)
+	}
+	var resolved ResolvedVersion
+	err = json.NewDecoder(bufio.NewReader(binresp.Body)).Decode(&resolved)
+	if err != nil {
+		return nil, err
+	}
+	if resolved.Number == "" || resolved.Version == nil {
+		return nil, errors.New("Invalid latest version response")
+	}
+	return &resolved, nil
 }
 
 func (c *Client) Version(release string, versionstr string) (*Version, error) {
-	req, err := http.NewRequest("GET", c.cleanHost()+"/releases/"+release+"/"+versionstr, nil)
+	return c.VersionContext(context.Background(), release, versionstr)
+}
+
+// VersionContext is like Version but aborts the request if ctx is done.
+func (c *Client) VersionContext(ctx context.Context, release string, versionstr string) (*Version, error) {
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+	req, err := c.newRequest(ctx, "GET", "/releases/"+release+"/"+versionstr, c.readToken, nil)
 	if err != nil {
 		return nil, err
 	}
-	req.Header.Set("X-PUSHR-TOKEN", c.readToken)
 	req.Header.Set("Accept", "application/json")
-	client := &http.Client{}
-	binresp, err := client.Do(req)
+	binresp, err := c.httpClient.Do(req)
 	if err != nil {
 		return nil, err
 	}
 	defer binresp.Body.Close()
+	if binresp.StatusCode != http.StatusOK {
+		return nil, newStatusError(binresp)
+	}
 	r := bufio.NewReader(binresp.Body)
 	var version Version
 	err = json.NewDecoder(r).Decode(&version)
@@ -142,52 +542,616 @@ func (c *Client) Version(release string, versionstr string) (*Version, error) {
 	return &version, nil
 }
 
+// Download writes the given version of release to filename.
+// If the server announces a Digest, the file is verified and removed on mismatch with a *ChecksumError.
+// Interrupted downloads are kept as filename.part and resumed by the next call.
 func (c *Client) Download(release string, versionstr string, filename string) error {
-	req, err := http.NewRequest("GET", c.cleanHost()+"/releases/"+release+"/"+versionstr, nil)
+	return c.DownloadContext(context.Background(), release, versionstr, filename)
+}
+
+// DownloadContext is like Download but aborts the request if ctx is done.
+func (c *Client) DownloadContext(ctx context.Context, release string, versionstr string, filename string) error {
+	return c.download(ctx, "/releases/"+release+"/"+versionstr, filename)
+}
+
+// DownloadFor downloads the artifact of the given version for goos and goarch to filename.
+// Empty goos and goarch default to the platform of the running binary.
+func (c *Client) DownloadFor(release string, versionstr string, goos string, goarch string, filename string) error {
+	return c.DownloadForContext(context.Background(), release, versionstr, goos, goarch, filename)
+}
+
+// DownloadForContext is like DownloadFor but aborts the request if ctx is done.
+func (c *Client) DownloadForContext(ctx context.Context, release string, versionstr string, goos string, goarch string, filename string) error {
+	p := CurrentPlatform()
+	if goos != "" {
+		p.OS = goos
+	}
+	if goarch != "" {
+		p.Arch = goarch
+	}
+	return c.DownloadPlatformContext(ctx, release, versionstr, p, filename)
+}
+
+// DownloadPlatform downloads the artifact of the given version for the platform p to filename.
+func (c *Client) DownloadPlatform(release string, versionstr string, p Platform, filename string) error {
+	return c.DownloadPlatformContext(context.Background(), release, versionstr, p, filename)
+}
+
+// DownloadPlatformContext is like DownloadPlatform but aborts the request if ctx is done.
+func (c *Client) DownloadPlatformContext(ctx context.Context, release string, versionstr string, p Platform, filename string) error {
+	return c.download(ctx, "/releases/"+release+"/"+versionstr+"/"+p.OS+"/"+p.Arch+variantQuery(p), filename)
+}
+
+// download writes the file at path to filename, verifying it against the Digest announced by the server.
+// The file is written to filename.part first and renamed once complete. An existing part file
+// of an earlier interrupted download is resumed with a range request if the file did not change in between.
+func (c *Client) download(ctx context.Context, path string, filename string) error {
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+
+	part := filename + ".part"
+	etagFile := part + ".etag"
+	var offset int64
+	etag, err := ioutil.ReadFile(etagFile)
+	if err == nil && len(etag) > 0 {
+		if fi, err := os.Stat(part); err == nil {
+			offset = fi.Size()
+		}
+	}
+
+	req, err := c.newRequest(ctx, "GET", path, c.readToken, nil)
 	if err != nil {
 		return err
 	}
-	req.Header.Set("X-PUSHR-TOKEN", c.readToken)
 	req.Header.Set("Accept", "application/octet-stream")
-	client := &http.Client{}
-	binresp, err := client.Do(req)
+	if offset > 0 {
+		req.Header.Set("Range", "bytes="+strconv.FormatInt(offset, 10)+"-")
+		req.Header.Set("If-Range", string(etag))
+	}
+	binresp, err := c.httpClient.Do(req)
 	if err != nil {
 		return err
 	}
 	defer binresp.Body.Close()
-	r := bufio.NewReader(binresp.Body)
 
-	f, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0666)
+	switch {
+	case binresp.StatusCode == http.StatusPartialContent && offset > 0 && contentRangeStart(binresp) == offset:
+	case binresp.StatusCode == http.StatusRequestedRangeNotSatisfiable && offset > 0:
+		// Part file is not a prefix of the current file, start over
+		os.Remove(part)
+		os.Remove(etagFile)
+		return c.download(ctx, path, filename)
+	case binresp.StatusCode == http.StatusOK:
+		offset = 0
+	default:
+		return newStatusError(binresp)
+	}
+
+	flags := os.O_WRONLY | os.O_CREATE
+	if offset == 0 {
+		flags |= os.O_TRUNC
+	}
+	f, err := os.OpenFile(part, flags, 0666)
+	if err != nil {
+		return err
+	}
+	if offset == 0 {
+		os.Remove(etagFile)
+		if etag := binresp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+			ioutil.WriteFile(etagFile, []byte(etag), 0666)
+		}
+	}
+
+	// The digest and signature cover the whole file, including the part downloaded before
+	verifier := newDigestVerifier(binresp.Header.Get("Digest"))
+	signed := sha512.New()
+	hashes := io.MultiWriter(verifier, signed)
+	if offset > 0 {
+		err = hashPrefix(part, offset, hashes)
+	}
+	if err == nil {
+		_, err = f.Seek(offset, io.SeekStart)
+	}
+	if err == nil {
+		w := bufio.NewWriter(f)
+		_, err = io.Copy(io.MultiWriter(w, hashes), bufio.NewReader(binresp.Body))
+		// Flush on error too, everything received so far can be resumed
+		if ferr := w.Flush(); err == nil {
+			err = ferr
+		}
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		// Keep the part file to resume later
+		return err
+	}
+	err = verifier.Verify()
+	if err == nil && len(c.publicKeys) > 0 {
+		err = VerifySignature(c.publicKeys, signed.Sum(nil), binresp.Header.Get(SignatureHeader))
+	}
+	if err != nil {
+		os.Remove(part)
+		os.Remove(etagFile)
+		return err
+	}
+	if err := os.Rename(part, filename); err != nil {
+		return err
+	}
+	os.Remove(etagFile)
+	return nil
+}
+
+// contentRangeStart returns the first byte position of the Content-Range of a partial response or -1.
+func contentRangeStart(resp *http.Response) int64 {
+	var start, end, size int64
+	if _, err := fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes %d-%d/%d", &start, &end, &size); err != nil {
+		return -1
+	}
+	return start
+}
+
+// hashPrefix writes the first n bytes of the file at path to w.
+func hashPrefix(path string, n int64, w io.Writer) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.CopyN(w, f, n)
+	return err
+}
+
+// Upload streams r to the server as the given version of release.
+// The filename is only used to determine the file extension.
+// Large uploads of known size are sent in resumable chunks, see WithChunkedUpload.
+func (c *Client) Upload(release string, versionstr string, filename string, r io.Reader) error {
+	return c.UploadContext(context.Background(), release, versionstr, filename, r)
+}
+
+// UploadContext is like Upload but aborts the request if ctx is done.
+func (c *Client) UploadContext(ctx context.Context, release string, versionstr string, filename string, r io.Reader) error {
+	return c.upload(ctx, &UploadSession{Release: release, Version: versionstr, Filename: filename}, r, readerSize(r), "")
+}
+
+// UploadFile uploads the file at path as the given version of release.
+// The server verifies the upload against the size and SHA-256 checksum of the file.
+func (c *Client) UploadFile(release string, versionstr string, path string) error {
+	return c.UploadFileContext(context.Background(), release, versionstr, path)
+}
+
+// UploadFileContext is like UploadFile but aborts the request if ctx is done.
+func (c *Client) UploadFileContext(ctx context.Context, release string, versionstr string, path string) error {
+	return c.uploadFile(ctx, &UploadSession{Release: release, Version: versionstr, Filename: filepath.Base(path)}, path)
+}
+
+// UploadPlatform streams r to the server as the artifact for platform p of the given version.
+// The filename is only used to determine the file extension.
+func (c *Client) UploadPlatform(release string, versionstr string, p Platform, filename string, r io.Reader) error {
+	return c.UploadPlatformContext(context.Background(), release, versionstr, p, filename, r)
+}
+
+// UploadPlatformContext is like UploadPlatform but aborts the request if ctx is done.
+func (c *Client) UploadPlatformContext(ctx context.Context, release string, versionstr string, p Platform, filename string, r io.Reader) error {
+	return c.upload(ctx, &UploadSession{Release: release, Version: versionstr, Filename: filename, Platform: &p}, r, readerSize(r), "")
+}
+
+// UploadFilePlatform uploads the file at path as the artifact for platform p of the given version.
+func (c *Client) UploadFilePlatform(release string, versionstr string, p Platform, path string) error {
+	return c.UploadFilePlatformContext(context.Background(), release, versionstr, p, path)
+}
+
+// UploadFilePlatformContext is like UploadFilePlatform but aborts the request if ctx is done.
+func (c *Client) UploadFilePlatformContext(ctx context.Context, release string, versionstr string, p Platform, path string) error {
+	return c.uploadFile(ctx, &UploadSession{Release: release, Version: versionstr, Filename: filepath.Base(path), Platform: &p}, path)
+}
+
+func variantQuery(p Platform) string {
+	if p.Variant == "" {
+		return ""
+	}
+	return "?variant=" + url.QueryEscape(p.Variant)
+}
+
+// uploadFile uploads the file at localPath, announcing its size and SHA-256 checksum.
+func (c *Client) uploadFile(ctx context.Context, target *UploadSession, localPath string) error {
+	f, err := os.Open(localPath)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return c.upload(ctx, target, f, size, DigestHeader(hex.EncodeToString(h.Sum(nil)), ""))
+}
 
-	w := bufio.NewWriter(f)
-	buf := make([]byte, 1024)
-	for {
-		// read a chunk
-		n, err := r.Read(buf)
-		if err != nil && err != io.EOF {
+// upload sends r to the server as target, announcing its size if not negative and its Digest if not empty.
+// Uploads of at least the chunk threshold use a resumable upload session if the server supports them.
+func (c *Client) upload(ctx context.Context, target *UploadSession, r io.Reader, size int64, digest string) error {
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+	if c.signingKey != nil {
+		signed := *target
+		var err error
+		r, size, signed.Signature, err = c.sign(r, size)
+		if err != nil {
 			return err
 		}
-		if n == 0 {
-			break
+		target = &signed
+	}
+	if c.chunkThreshold > 0 && size >= c.chunkThreshold {
+		err := c.uploadChunked(ctx, target, r, size, digest)
+		if err != errSessionsUnsupported {
+			return err
 		}
+	}
 
-		// write a chunk
-		if _, err := w.Write(buf[:n]); err != nil {
-			return err
+	// File names of UploadFile are taken from the local file and may contain # or ?
+	filename := url.PathEscape(target.Filename)
+	path := "/releases/" + target.Release + "/" + target.Version + "/" + filename
+	if p := target.Platform; p != nil {
+		path = "/releases/" + target.Release + "/" + target.Version + "/" + url.PathEscape(p.OS) + "/" + url.PathEscape(p.Arch) + "/" + filename + variantQuery(*p)
+	} else if target.Notes != "" {
+		path += "?notes=" + url.QueryEscape(target.Notes)
+	}
+	req, err := c.newRequest(ctx, "POST", path, c.writeToken, r)
+	if err != nil {
+		return err
+	}
+	if size >= 0 {
+		req.ContentLength = size
+	}
+	if digest != "" {
+		req.Header.Set("Digest", digest)
+	}
+	if target.Signature != "" {
+		req.Header.Set(SignatureHeader, target.Signature)
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return newStatusError(resp)
+	}
+	return nil
+}
+
+// readerSize returns the number of bytes left in r if known without reading, otherwise -1.
+func readerSize(r io.Reader) int64 {
+	switch r := r.(type) {
+	case interface{ Len() int }:
+		return int64(r.Len())
+	case *os.File:
+		fi, err := r.Stat()
+		if err != nil || !fi.Mode().IsRegular() {
+			return -1
+		}
+		offset, err := r.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return -1
 		}
+		return fi.Size() - offset
+	}
+	return -1
+}
+
+// Delete removes the given version of release from the server.
+// Versions a channel points to are not deleted, the server responds with ErrConflict.
+// Promote another version or remove the channel pointer with Unpromote first.
+func (c *Client) Delete(release string, versionstr string) error {
+	return c.DeleteContext(context.Background(), release, versionstr)
+}
+
+// DeleteContext is like Delete but aborts the request if ctx is done.
+func (c *Client) DeleteContext(ctx context.Context, release string, versionstr string) error {
+	return c.write(ctx, "DELETE", "/releases/"+release+"/"+versionstr)
+}
+
+// Yank hides the given version of release from listings and LatestVersion.
+// It can still be downloaded by its exact version.
+func (c *Client) Yank(release string, versionstr string) error {
+	return c.YankContext(context.Background(), release, versionstr)
+}
+
+// YankContext is like Yank but aborts the request if ctx is done.
+func (c *Client) YankContext(ctx context.Context, release string, versionstr string) error {
+	return c.write(ctx, "POST", "/releases/"+release+"/"+versionstr+"/yank")
+}
+
+// Unyank restores a yanked version.
+func (c *Client) Unyank(release string, versionstr string) error {
+	return c.UnyankContext(context.Background(), release, versionstr)
+}
+
+// UnyankContext is like Unyank but aborts the request if ctx is done.
+func (c *Client) UnyankContext(ctx context.Context, release string, versionstr string) error {
+	return c.write(ctx, "DELETE", "/releases/"+release+"/"+versionstr+"/yank")
+}
+
+// Promote points channel of release to the given version.
+// The channel is created if it does not exist yet.
+func (c *Client) Promote(release string, channel string, versionstr string) error {
+	return c.PromoteContext(context.Background(), release, channel, versionstr)
+}
+
+// PromoteContext is like Promote but aborts the request if ctx is done.
+func (c *Client) PromoteContext(ctx context.Context, release string, channel string, versionstr string) error {
+	return c.write(ctx, "POST", "/releases/"+release+"/channels/"+channel+"?version="+url.QueryEscape(versionstr))
+}
+
+// Unpromote removes the version pointer of channel of release, the channel follows the newest version again.
+// The removal is recorded in the channel history.
+func (c *Client) Unpromote(release string, channel string) error {
+	return c.UnpromoteContext(context.Background(), release, channel)
+}
+
+// UnpromoteContext is like Unpromote but aborts the request if ctx is done.
+func (c *Client) UnpromoteContext(ctx context.Context, release string, channel string) error {
+	return c.write(ctx, "DELETE", "/releases/"+release+"/channels/"+channel)
+}
+
+// Channel returns the version promoted into channel of release including the promotion history.
+func (c *Client) Channel(release string, channel string) (*Channel, error) {
+	return c.ChannelContext(context.Background(), release, channel)
+}
+
+// ChannelContext is like Channel but aborts the request if ctx is done.
+func (c *Client) ChannelContext(ctx context.Context, release string, channel string) (*Channel, error) {
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+	req, err := c.newRequest(ctx, "GET", "/releases/"+release+"/channels/"+channel, c.readToken, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
 	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, newStatusError(resp)
+	}
+	var ch Channel
+	if err := json.NewDecoder(resp.Body).Decode(&ch); err != nil {
+		return nil, err
+	}
+	return &ch, nil
+}
+
+// Stats returns the download statistics of release.
+func (c *Client) Stats(release string) (*ReleaseStats, error) {
+	return c.StatsContext(context.Background(), release)
+}
+
+// StatsContext is like Stats but aborts the request if ctx is done.
+func (c *Client) StatsContext(ctx context.Context, release string) (*ReleaseStats, error) {
+	var stats ReleaseStats
+	if err := c.getJSON(ctx, "/releases/"+release+"/stats", &stats); err != nil {
+		return nil, err
+	}
+	return &stats, nil
+}
+
+// VersionStats returns the download statistics of the given version of release.
+func (c *Client) VersionStats(release string, versionstr string) (*DownloadStats, error) {
+	return c.VersionStatsContext(context.Background(), release, versionstr)
+}
 
-	if err = w.Flush(); err != nil {
+// VersionStatsContext is like VersionStats but aborts the request if ctx is done.
+func (c *Client) VersionStatsContext(ctx context.Context, release string, versionstr string) (*DownloadStats, error) {
+	var stats DownloadStats
+	if err := c.getJSON(ctx, "/releases/"+release+"/"+versionstr+"/stats", &stats); err != nil {
+		return nil, err
+	}
+	return &stats, nil
+}
+
+// getJSON decodes the response of a GET request using the read token into v.
+func (c *Client) getJSON(ctx context.Context, path string, v interface{}) error {
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+	req, err := c.newRequest(ctx, "GET", path, c.readToken, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
 		return err
 	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return newStatusError(resp)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// SignedURL returns a download link of the given version of release, valid without token for the duration expiry.
+// Links can be shared without exposing a token. The server limits the expiry to 7 days and
+// uses a default of one hour if expiry is zero.
+func (c *Client) SignedURL(release string, versionstr string, expiry time.Duration) (*SignedURL, error) {
+	return c.SignedURLContext(context.Background(), release, versionstr, expiry)
+}
+
+// SignedURLContext is like SignedURL but aborts the request if ctx is done.
+func (c *Client) SignedURLContext(ctx context.Context, release string, versionstr string, expiry time.Duration) (*SignedURL, error) {
+	return c.signedURL(ctx, release, versionstr, nil, expiry)
+}
+
+// SignedPlatformURL is like SignedURL but links to the artifact for platform p.
+func (c *Client) SignedPlatformURL(release string, versionstr string, p Platform, expiry time.Duration) (*SignedURL, error) {
+	return c.SignedPlatformURLContext(context.Background(), release, versionstr, p, expiry)
+}
+
+// SignedPlatformURLContext is like SignedPlatformURL but aborts the request if ctx is done.
+func (c *Client) SignedPlatformURLContext(ctx context.Context, release string, versionstr string, p Platform, expiry time.Duration) (*SignedURL, error) {
+	return c.signedURL(ctx, release, versionstr, &p, expiry)
+}
+
+func (c *Client) signedURL(ctx context.Context, release string, versionstr string, p *Platform, expiry time.Duration) (*SignedURL, error) {
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+	query := url.Values{}
+	if expiry > 0 {
+		query.Set("expires", expiry.String())
+	}
+	if p != nil {
+		query.Set("os", p.OS)
+		query.Set("arch", p.Arch)
+		if p.Variant != "" {
+			query.Set("variant", p.Variant)
+		}
+	}
+	path := "/releases/" + release + "/" + versionstr + "/link"
+	if len(query) > 0 {
+		path += "?" + query.Encode()
+	}
+	req, err := c.newRequest(ctx, "POST", path, c.readToken, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return nil, newStatusError(resp)
+	}
+	var link SignedURL
+	if err := json.NewDecoder(resp.Body).Decode(&link); err != nil {
+		return nil, err
+	}
+	// The server returns the path only, it does not know how it is reached
+	link.URL = c.cleanHost() + link.URL
+	return &link, nil
+}
+
+// Tokens lists the API tokens of the server, it requires a token with admin scope.
+func (c *Client) Tokens() ([]*Token, error) {
+	return c.TokensContext(context.Background())
+}
+
+// TokensContext is like Tokens but aborts the request if ctx is done.
+func (c *Client) TokensContext(ctx context.Context) ([]*Token, error) {
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+	req, err := c.newRequest(ctx, "GET", "/tokens", c.writeToken, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, newStatusError(resp)
+	}
+	var tokens []*Token
+	if err := json.NewDecoder(resp.Body).Decode(&tokens); err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+// CreateToken creates an API token with the name, scopes, release patterns and expiry of token.
+// The returned token contains the secret, which can not be retrieved later.
+func (c *Client) CreateToken(token *Token) (*Token, error) {
+	return c.CreateTokenContext(context.Background(), token)
+}
+
+// CreateTokenContext is like CreateToken but aborts the request if ctx is done.
+func (c *Client) CreateTokenContext(ctx context.Context, token *Token) (*Token, error) {
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+	b, err := json.Marshal(token)
+	if err != nil {
+		return nil, err
+	}
+	req, err := c.newRequest(ctx, "POST", "/tokens", c.writeToken, bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return nil, newStatusError(resp)
+	}
+	var created Token
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil {
+		return nil, err
+	}
+	return &created, nil
+}
+
+// RevokeToken deletes the API token with the given name.
+func (c *Client) RevokeToken(name string) error {
+	return c.RevokeTokenContext(context.Background(), name)
+}
+
+// RevokeTokenContext is like RevokeToken but aborts the request if ctx is done.
+func (c *Client) RevokeTokenContext(ctx context.Context, name string) error {
+	return c.write(ctx, "DELETE", "/tokens/"+url.PathEscape(name))
+}
 
+// write sends a bodyless request using the write token.
+func (c *Client) write(ctx context.Context, method string, path string) error {
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+	req, err := c.newRequest(ctx, method, path, c.writeToken, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return newStatusError(resp)
+	}
 	return nil
 }
 
+func (c *Client) newRequest(ctx context.Context, method string, path string, token string, body io.Reader) (*http.Request, error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+	req, err := http.NewRequest(method, c.cleanHost()+path, body)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("X-PUSHR-TOKEN", token)
+	if c.userAgent != "" {
+		req.Header.Set("User-Agent", c.userAgent)
+	}
+	return req, nil
+}
+
+func (c *Client) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if c.timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, c.timeout)
+}
+
 func (c *Client) cleanHost() string {
 	return strings.TrimSuffix(c.host, "/")
 }
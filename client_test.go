@@ -1,15 +1,28 @@
 package pushr
 
 import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"reflect"
+	"runtime"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestLatestRelease(t *testing.T) {
@@ -40,7 +53,10 @@ func TestLatestRelease(t *testing.T) {
 			return
 		}
 		t.Logf("URL: %s", requestedURL)
-		if requestedURL == "/releases/test" {
+		if r.URL.Path == "/releases/test/latest" {
+			// Server without latest endpoint
+			w.WriteHeader(http.StatusNotFound)
+		} else if requestedURL == "/releases/test" {
 			w.Header().Set("Content-Type", "application/json")
 			err := json.NewEncoder(w).Encode(&testRelease)
 			if err != nil {
@@ -73,7 +89,7 @@ func TestLatestRelease(t *testing.T) {
 		t.Fatal("No Release found")
 	}
 	if !reflect.DeepEqual(r, &testRelease) {
-		t.Fatalf("Release deep equal failed: expected %q, got %q", testRelease, r)
+		t.Fatalf("Release deep equal failed: expected %v, got %v", testRelease, r)
 	}
 
 	// Get Version
@@ -85,7 +101,7 @@ func TestLatestRelease(t *testing.T) {
 		t.Fatal("No version found")
 	}
 	if !reflect.DeepEqual(v, testRelease.Versions["1.0.0"]) {
-		t.Fatalf("Version deep equal failed: expected %q, got %q", testRelease.Versions["1.0.0"], v)
+		t.Fatalf("Version deep equal failed: expected %v, got %v", testRelease.Versions["1.0.0"], v)
 	}
 
 	// Setup asset download
@@ -114,7 +130,7 @@ func TestLatestRelease(t *testing.T) {
 	//Get latest stable version
 	v, versionStr, err := c.LatestVersion("test", "") //stable
 	if !reflect.DeepEqual(v, testRelease.Versions["1.0.0"]) {
-		t.Fatalf("Latest version on stable channel failed: expected %q, got %q", testRelease.Versions["1.0.0"], v)
+		t.Fatalf("Latest version on stable channel failed: expected %v, got %v", testRelease.Versions["1.0.0"], v)
 	}
 	if versionStr != "1.0.0" {
 		t.Fatalf("Latest version mismatch: expected %s, got %s", "1.0.0", versionStr)
@@ -122,7 +138,7 @@ func TestLatestRelease(t *testing.T) {
 
 	v, versionStr, err = c.LatestVersion("test", "stable") //stable
 	if !reflect.DeepEqual(v, testRelease.Versions["1.0.0"]) {
-		t.Fatalf("Latest version on stable channel failed: expected %q, got %q", testRelease.Versions["1.0.0"], v)
+		t.Fatalf("Latest version on stable channel failed: expected %v, got %v", testRelease.Versions["1.0.0"], v)
 	}
 	if versionStr != "1.0.0" {
 		t.Fatalf("Latest version mismatch: expected %s, got %s", "1.0.0", versionStr)
@@ -130,9 +146,747 @@ func TestLatestRelease(t *testing.T) {
 
 	v, versionStr, err = c.LatestVersion("test", "beta") //stable
 	if !reflect.DeepEqual(v, testRelease.Versions["1.0.1-beta"]) {
-		t.Fatalf("Latest version on stable channel failed: expected %q, got %q", testRelease.Versions["1.0.1-beta"], v)
+		t.Fatalf("Latest version on stable channel failed: expected %v, got %v", testRelease.Versions["1.0.1-beta"], v)
 	}
 	if versionStr != "1.0.1-beta" {
 		t.Fatalf("Latest version mismatch: expected %s, got %s", "1.0.1-beta", versionStr)
 	}
 }
+
+func TestUpload(t *testing.T) {
+	var uploaded []byte
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			t.Errorf("Wrong method: %s", r.Method)
+		}
+		if token := r.Header.Get("X-PUSHR-TOKEN"); token != "WRITE123" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.String() {
+		case "/releases/test/1.0.0/test.zip":
+			b, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				t.Fatalf("Could not read upload: %s", err)
+			}
+			uploaded = b
+			w.WriteHeader(http.StatusCreated)
+		case "/releases/test/0.1.0/test.zip":
+			w.WriteHeader(http.StatusConflict)
+			fmt.Fprint(w, "Error: Version already found")
+		case "/releases/test/invalid/test.zip":
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, "Error processing version")
+		default:
+			t.Errorf("Wrong url requested: %q", r.URL.String())
+		}
+	}))
+	defer ts.Close()
+
+	c := NewClient(ts.URL, "READ123", "WRITE123")
+	if err := c.Upload("test", "1.0.0", "test.zip", strings.NewReader("TESTINPUT")); err != nil {
+		t.Fatalf("Error while uploading: %s", err)
+	}
+	if string(uploaded) != "TESTINPUT" {
+		t.Errorf("Uploaded wrong data: %q", string(uploaded))
+	}
+
+	err := c.Upload("test", "0.1.0", "test.zip", strings.NewReader("TESTINPUT"))
+	if !errors.Is(err, ErrConflict) {
+		t.Errorf("Expected conflict error, got %v", err)
+	}
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) || statusErr.Body != "Error: Version already found" {
+		t.Errorf("Expected status error with body, got %v", err)
+	}
+
+	err = c.Upload("test", "invalid", "test.zip", strings.NewReader("TESTINPUT"))
+	if !errors.Is(err, ErrBadRequest) {
+		t.Errorf("Expected bad request error, got %v", err)
+	}
+
+	c = NewClient(ts.URL, "READ123", "WRONG")
+	err = c.Upload("test", "1.0.0", "test.zip", strings.NewReader("TESTINPUT"))
+	if !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("Expected unauthorized error, got %v", err)
+	}
+
+	// Upload from file
+	tmpFile, err := ioutil.TempFile("", "pushrtest")
+	if err != nil {
+		t.Fatalf("Could not create test temp file: %s", err)
+	}
+	defer os.Remove(tmpFile.Name())
+	tmpFile.WriteString("TESTFILE")
+	tmpFile.Close()
+	// Characters with a meaning in URLs are escaped
+	renamed := tmpFile.Name() + " #1?.zip"
+	if err := os.Rename(tmpFile.Name(), renamed); err != nil {
+		t.Fatalf("Could not rename test temp file: %s", err)
+	}
+	defer os.Remove(renamed)
+
+	ts.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/releases/test/1.0.0/"+filepath.Base(renamed) || r.URL.RawQuery != "" {
+			t.Errorf("Wrong url requested: %q", r.URL.String())
+		}
+		uploaded, _ = ioutil.ReadAll(r.Body)
+		sum := sha256.Sum256(uploaded)
+		if digest := ParseDigest(r.Header.Get("Digest")); digest["SHA-256"] != hex.EncodeToString(sum[:]) {
+			t.Errorf("Wrong digest announced: %v", digest)
+		}
+		if r.ContentLength != int64(len(uploaded)) {
+			t.Errorf("Wrong content length announced: %d", r.ContentLength)
+		}
+		w.WriteHeader(http.StatusCreated)
+	})
+	c = NewClient(ts.URL, "READ123", "WRITE123")
+	if err := c.UploadFile("test", "1.0.0", renamed); err != nil {
+		t.Fatalf("Error while uploading file: %s", err)
+	}
+	if string(uploaded) != "TESTFILE" {
+		t.Errorf("Uploaded wrong data: %q", string(uploaded))
+	}
+}
+
+func TestStatusErrors(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token := r.Header.Get("X-PUSHR-TOKEN"); token != "TOKEN123" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer ts.Close()
+
+	c := NewClient(ts.URL, "TOKEN123", "")
+	if _, err := c.Release("test"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected not found error on release, got %v", err)
+	}
+	if _, err := c.Version("test", "1.0.0"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected not found error on version, got %v", err)
+	}
+	if _, _, err := c.LatestVersion("test", ""); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected not found error on latest version, got %v", err)
+	}
+
+	c = NewClient(ts.URL, "WRONG", "")
+	_, err := c.Release("test")
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected status error with code 401, got %v", err)
+	}
+	if !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("Expected unauthorized error, got %v", err)
+	}
+
+	// Download must not create the target file on error
+	tmpDir, err := ioutil.TempDir("", "pushrtest")
+	if err != nil {
+		t.Fatalf("Could not create test temp dir: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	filename := filepath.Join(tmpDir, "test.zip")
+	if err := c.Download("test", "1.0.0", filename); !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("Expected unauthorized error on download, got %v", err)
+	}
+	if _, err := os.Stat(filename); !os.IsNotExist(err) {
+		t.Errorf("Download created file on error: %v", err)
+	}
+}
+
+func TestClientOptions(t *testing.T) {
+	block := make(chan struct{})
+	var mu sync.Mutex
+	var userAgent string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		userAgent = r.Header.Get("User-Agent")
+		mu.Unlock()
+		if r.URL.Path == "/releases/slow" {
+			<-block
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"versions":{}}`)
+	}))
+	defer ts.Close()
+	defer close(block)
+
+	var transportUsed bool
+	httpClient := &http.Client{
+		Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			transportUsed = true
+			return http.DefaultTransport.RoundTrip(req)
+		}),
+	}
+	c := NewClient(ts.URL, "", "", WithHTTPClient(httpClient), WithUserAgent("pushr-test/1.0"))
+	if _, err := c.Release("test"); err != nil {
+		t.Fatalf("Error while getting release: %s", err)
+	}
+	if !transportUsed {
+		t.Error("Custom http client was not used")
+	}
+	mu.Lock()
+	if userAgent != "pushr-test/1.0" {
+		t.Errorf("Wrong user agent: %q", userAgent)
+	}
+	mu.Unlock()
+
+	// Cancellation
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := c.ReleaseContext(ctx, "slow"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected deadline exceeded, got %v", err)
+	}
+
+	// Base timeout
+	c = NewClient(ts.URL, "", "", WithTimeout(50*time.Millisecond))
+	if _, err := c.Release("slow"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected deadline exceeded from base timeout, got %v", err)
+	}
+
+	// TLS options can not be applied to other transports and are not dropped silently
+	transportUsed = false
+	c = NewClient(ts.URL, "", "", WithHTTPClient(httpClient), WithRootCAs(x509.NewCertPool()))
+	if _, err := c.Release("test"); err == nil || transportUsed {
+		t.Errorf("Request with unsupported transport for TLS options was sent: %v", err)
+	}
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestDownloadChecksum(t *testing.T) {
+	content := "TESTOUTPUT"
+	sum := sha256.Sum256([]byte(content))
+	goodDigest := DigestHeader(hex.EncodeToString(sum[:]), "")
+	badSum := sha256.Sum256([]byte("OTHER"))
+	badDigest := DigestHeader(hex.EncodeToString(badSum[:]), "")
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.String() {
+		case "/releases/test/1.0.0":
+			w.Header().Set("Digest", goodDigest)
+		case "/releases/test/1.0.1":
+			w.Header().Set("Digest", badDigest)
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		fmt.Fprint(w, content)
+	}))
+	defer ts.Close()
+
+	tmpDir, err := ioutil.TempDir("", "pushrtest")
+	if err != nil {
+		t.Fatalf("Could not create test temp dir: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	filename := filepath.Join(tmpDir, "test.zip")
+
+	c := NewClient(ts.URL, "", "")
+	if err := c.Download("test", "1.0.0", filename); err != nil {
+		t.Fatalf("Error while downloading verified asset: %s", err)
+	}
+	if b, _ := ioutil.ReadFile(filename); string(b) != content {
+		t.Errorf("Written asset file contains wrong data: %q", string(b))
+	}
+	os.Remove(filename)
+
+	err = c.Download("test", "1.0.1", filename)
+	var checksumErr *ChecksumError
+	if !errors.As(err, &checksumErr) {
+		t.Fatalf("Expected checksum error, got %v", err)
+	}
+	if checksumErr.Algorithm != "SHA-256" || checksumErr.Actual != hex.EncodeToString(sum[:]) {
+		t.Errorf("Wrong checksum error: %v", checksumErr)
+	}
+	if _, err := os.Stat(filename); !os.IsNotExist(err) {
+		t.Errorf("Download did not remove corrupt file: %v", err)
+	}
+}
+
+func TestDeleteAndYank(t *testing.T) {
+	var requests []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token := r.Header.Get("X-PUSHR-TOKEN"); token != "WRITE123" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		requests = append(requests, r.Method+" "+r.URL.String())
+		if r.URL.String() == "/releases/test/0.1.0" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	c := NewClient(ts.URL, "", "WRITE123")
+	if err := c.Yank("test", "1.0.0"); err != nil {
+		t.Errorf("Error while yanking: %s", err)
+	}
+	if err := c.Unyank("test", "1.0.0"); err != nil {
+		t.Errorf("Error while unyanking: %s", err)
+	}
+	if err := c.Delete("test", "1.0.0"); err != nil {
+		t.Errorf("Error while deleting: %s", err)
+	}
+	if err := c.Delete("test", "0.1.0"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected not found error, got %v", err)
+	}
+	expected := []string{"POST /releases/test/1.0.0/yank", "DELETE /releases/test/1.0.0/yank", "DELETE /releases/test/1.0.0", "DELETE /releases/test/0.1.0"}
+	if !reflect.DeepEqual(requests, expected) {
+		t.Errorf("Wrong requests: expected %v, got %v", expected, requests)
+	}
+}
+
+func TestLatestVersionSkipsYanked(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/releases/test" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(&Release{
+			Versions: map[string]*Version{
+				"1.1.0": &Version{Filename: "test-1.1.0.zip", Yanked: true},
+				"1.0.0": &Version{Filename: "test-1.0.0.zip"},
+			},
+		})
+	}))
+	defer ts.Close()
+
+	c := NewClient(ts.URL, "", "")
+	_, versionStr, err := c.LatestVersion("test", "")
+	if err != nil {
+		t.Fatalf("Error while getting latest version: %s", err)
+	}
+	if versionStr != "1.0.0" {
+		t.Errorf("Latest version mismatch: expected %s, got %s", "1.0.0", versionStr)
+	}
+}
+
+func TestLatestVersionServerSide(t *testing.T) {
+	var requests []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.URL.String())
+		if r.URL.Path != "/releases/test/latest" {
+			t.Errorf("Wrong url requested: %q", r.URL.String())
+			return
+		}
+		json.NewEncoder(w).Encode(&ResolvedVersion{
+			Number:  "1.1.0-beta",
+			Version: &Version{Filename: "test-1.1.0-beta.zip"},
+		})
+	}))
+	defer ts.Close()
+
+	c := NewClient(ts.URL, "", "")
+	v, versionStr, err := c.LatestVersion("test", "beta")
+	if err != nil {
+		t.Fatalf("Error while getting latest version: %s", err)
+	}
+	if versionStr != "1.1.0-beta" || v.Filename != "test-1.1.0-beta.zip" {
+		t.Errorf("Wrong latest version %s: %v", versionStr, v)
+	}
+	if !reflect.DeepEqual(requests, []string{"/releases/test/latest?channel=beta"}) {
+		t.Errorf("Wrong requests: %v", requests)
+	}
+}
+
+func TestLatestVersionFallback(t *testing.T) {
+	var latest func(w http.ResponseWriter)
+	var listed bool
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/releases/test/latest":
+			latest(w)
+		case "/releases/test":
+			listed = true
+			json.NewEncoder(w).Encode(&Release{Versions: map[string]*Version{"1.1.0-beta": &Version{Filename: "test-1.1.0-beta.zip"}}})
+		default:
+			t.Errorf("Wrong url requested: %q", r.URL.String())
+		}
+	}))
+	defer ts.Close()
+	c := NewClient(ts.URL, "", "")
+
+	// Older servers without latest endpoint
+	for _, status := range []int{http.StatusNotFound, http.StatusMethodNotAllowed} {
+		latest = func(w http.ResponseWriter) {
+			w.WriteHeader(status)
+		}
+		if _, versionStr, err := c.LatestVersion("test", "beta"); err != nil || versionStr != "1.1.0-beta" {
+			t.Errorf("Fallback on %d: got %s (%v)", status, versionStr, err)
+		}
+		if _, versionStr, err := c.LatestVersion("test", ""); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Fallback on %d for channel without version: expected not found, got %s (%v)", status, versionStr, err)
+		}
+	}
+
+	// A channel without version is not resolved again from the listing
+	latest = func(w http.ResponseWriter) {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, "Error: No version in this channel available")
+	}
+	listed = false
+	if _, versionStr, err := c.LatestVersion("test", ""); !errors.Is(err, ErrNotFound) || listed {
+		t.Errorf("Expected not found without listing, got %s (%v), listed %t", versionStr, err, listed)
+	}
+}
+
+func TestReleaseLatest(t *testing.T) {
+	r := &Release{
+		Versions: map[string]*Version{
+			"0.9.0":        &Version{},
+			"1.0.0":        &Version{},
+			"1.1.0-beta.1": &Version{},
+			"1.2.0-alpha":  &Version{},
+			"1.3.0":        &Version{Yanked: true},
+		},
+	}
+	tests := map[string]string{
+		"":        "1.0.0",
+		"stable":  "1.0.0",
+		"beta":    "1.1.0-beta.1",
+		"alpha":   "1.2.0-alpha",
+		"nightly": "1.0.0",
+	}
+	for channel, expected := range tests {
+		_, versionStr, err := r.Latest(channel)
+		if err != nil || versionStr != expected {
+			t.Errorf("Latest in channel %q: expected %s, got %s (%v)", channel, expected, versionStr, err)
+		}
+	}
+
+	r = &Release{Versions: map[string]*Version{"1.0.0-beta": &Version{}}}
+	if _, _, err := r.Latest("stable"); err != ErrNoVersion {
+		t.Errorf("Expected no version error, got %v", err)
+	}
+}
+
+func TestPlatformArtifacts(t *testing.T) {
+	var uploads []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" {
+			b, _ := ioutil.ReadAll(r.Body)
+			uploads = append(uploads, r.URL.String()+" "+string(b))
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		switch r.URL.String() {
+		case "/releases/test/1.0.0/linux/arm?variant=v7":
+			fmt.Fprint(w, "ARM")
+		case "/releases/test/1.0.0/" + runtime.GOOS + "/" + runtime.GOARCH:
+			fmt.Fprint(w, "NATIVE")
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	tmpDir, err := ioutil.TempDir("", "pushrtest")
+	if err != nil {
+		t.Fatalf("Could not create test temp dir: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	filename := filepath.Join(tmpDir, "test.tar.gz")
+
+	c := NewClient(ts.URL, "", "")
+	if err := c.UploadPlatform("test", "1.0.0", Platform{OS: "linux", Arch: "arm", Variant: "v7"}, "test.tar.gz", strings.NewReader("ARM")); err != nil {
+		t.Fatalf("Error while uploading artifact: %s", err)
+	}
+	if len(uploads) != 1 || uploads[0] != "/releases/test/1.0.0/linux/arm/test.tar.gz?variant=v7 ARM" {
+		t.Errorf("Wrong artifact upload: %v", uploads)
+	}
+
+	if err := c.DownloadFor("test", "1.0.0", "", "", filename); err != nil {
+		t.Fatalf("Error while downloading native artifact: %s", err)
+	}
+	if b, _ := ioutil.ReadFile(filename); string(b) != "NATIVE" {
+		t.Errorf("Wrong native artifact: %q", string(b))
+	}
+	if err := c.DownloadPlatform("test", "1.0.0", Platform{OS: "linux", Arch: "arm", Variant: "v7"}, filename); err != nil {
+		t.Fatalf("Error while downloading artifact: %s", err)
+	}
+	if b, _ := ioutil.ReadFile(filename); string(b) != "ARM" {
+		t.Errorf("Wrong artifact: %q", string(b))
+	}
+	if err := c.DownloadFor("test", "1.0.0", "plan9", "386", filename); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected not found error for missing artifact, got %v", err)
+	}
+
+	if key := (Platform{OS: "linux", Arch: "arm", Variant: "v7"}).Key(); key != "linux/arm/v7" {
+		t.Errorf("Wrong platform key: %s", key)
+	}
+}
+
+func TestReleaseLatestChannels(t *testing.T) {
+	r := &Release{
+		Versions: map[string]*Version{
+			"1.0.0":        &Version{},
+			"1.3.0-beta.4": &Version{},
+			"1.4.0-beta.1": &Version{},
+			"1.5.0":        &Version{Yanked: true},
+		},
+		Channels: map[string]*Channel{
+			"stable":  &Channel{Version: "1.3.0-beta.4"},
+			"nightly": &Channel{Version: "1.4.0-beta.1"},
+			"beta":    &Channel{Version: "1.5.0"},
+			"alpha":   &Channel{Version: "2.0.0"},
+		},
+	}
+	tests := map[string]string{
+		"":        "1.3.0-beta.4",
+		"stable":  "1.3.0-beta.4",
+		"nightly": "1.4.0-beta.1",
+		"beta":    "1.4.0-beta.1", // Promoted version yanked
+		"alpha":   "1.0.0",        // Promoted version deleted
+	}
+	for channel, expected := range tests {
+		_, versionStr, err := r.Latest(channel)
+		if err != nil || versionStr != expected {
+			t.Errorf("Latest in channel %q: expected %s, got %s (%v)", channel, expected, versionStr, err)
+		}
+	}
+}
+
+func TestPromote(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method + " " + r.URL.String() {
+		case "POST /releases/test/channels/stable?version=1.3.0-beta.4":
+			w.WriteHeader(http.StatusNoContent)
+		case "POST /releases/test/channels/stable?version=9.9.9":
+			w.WriteHeader(http.StatusNotFound)
+		case "GET /releases/test/channels/stable":
+			fmt.Fprint(w, `{"version":"1.3.0-beta.4","history":[{"version":"1.3.0-beta.4","previous":"1.2.0"}]}`)
+		default:
+			t.Errorf("Wrong request: %s %s", r.Method, r.URL)
+		}
+	}))
+	defer ts.Close()
+
+	c := NewClient(ts.URL, "", "")
+	if err := c.Promote("test", "stable", "1.3.0-beta.4"); err != nil {
+		t.Fatalf("Error while promoting: %s", err)
+	}
+	if err := c.Promote("test", "stable", "9.9.9"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected not found error, got %v", err)
+	}
+	ch, err := c.Channel("test", "stable")
+	if err != nil {
+		t.Fatalf("Error while reading channel: %s", err)
+	}
+	if ch.Version != "1.3.0-beta.4" || len(ch.History) != 1 || ch.History[0].Previous != "1.2.0" {
+		t.Errorf("Wrong channel: %v", ch)
+	}
+}
+
+func TestResumeDownload(t *testing.T) {
+	content := strings.Repeat("0123456789", 1000)
+	sum := sha256.Sum256([]byte(content))
+	etag := `"` + hex.EncodeToString(sum[:]) + `"`
+	var ranges []string
+	interrupt := true
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.Header.Get("Range"))
+		if interrupt {
+			// Announce the full file but drop the connection halfway
+			interrupt = false
+			w.Header().Set("ETag", etag)
+			w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+			w.Write([]byte(content[:4000]))
+			w.(http.Flusher).Flush()
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+			return
+		}
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Digest", DigestHeader(hex.EncodeToString(sum[:]), ""))
+		http.ServeContent(w, r, "test.zip", time.Time{}, strings.NewReader(content))
+	}))
+	defer ts.Close()
+
+	tmpDir, err := ioutil.TempDir("", "pushrtest")
+	if err != nil {
+		t.Fatalf("Could not create test temp dir: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	filename := filepath.Join(tmpDir, "test.zip")
+	// Stale longer file from an earlier download
+	ioutil.WriteFile(filename, []byte(content+"STALE"), 0666)
+
+	c := NewClient(ts.URL, "", "")
+	if err := c.Download("test", "1.0.0", filename); err == nil {
+		t.Fatal("Expected error on interrupted download")
+	}
+	if fi, err := os.Stat(filename + ".part"); err != nil || fi.Size() != 4000 {
+		t.Fatalf("Part file not kept: %v", err)
+	}
+	if err := c.Download("test", "1.0.0", filename); err != nil {
+		t.Fatalf("Error while resuming download: %s", err)
+	}
+	if len(ranges) != 2 || ranges[0] != "" || ranges[1] != "bytes=4000-" {
+		t.Errorf("Wrong range requests: %q", ranges)
+	}
+	if b, _ := ioutil.ReadFile(filename); string(b) != content {
+		t.Errorf("Wrong content after resume: %d bytes", len(b))
+	}
+	if files, _ := ioutil.ReadDir(tmpDir); len(files) != 1 {
+		t.Errorf("Files left after download: %d files", len(files))
+	}
+
+	// Changed file on the server restarts the download
+	ioutil.WriteFile(filename+".part", []byte("OTHER"), 0666)
+	ioutil.WriteFile(filename+".part.etag", []byte(`"changed"`), 0666)
+	ranges = nil
+	if err := c.Download("test", "1.0.0", filename); err != nil {
+		t.Fatalf("Error while downloading changed file: %s", err)
+	}
+	if b, _ := ioutil.ReadFile(filename); string(b) != content {
+		t.Errorf("Wrong content after changed file: %d bytes", len(b))
+	}
+	if len(ranges) != 1 || ranges[0] != "bytes=5-" {
+		t.Errorf("Wrong range requests: %q", ranges)
+	}
+}
+
+func TestChunkedUpload(t *testing.T) {
+	content := strings.Repeat("0123456789", 1000)
+	var received []byte
+	var patches, patchStatus int
+	sessions := true
+	aborted := false
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method + " " + r.URL.Path {
+		case "POST /uploads":
+			if !sessions {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			var session UploadSession
+			json.NewDecoder(r.Body).Decode(&session)
+			if session.Release != "test" || session.Version != "1.0.0" || session.Filename != "test.zip" || session.Size != int64(len(content)) {
+				t.Errorf("Wrong session: %v", session)
+			}
+			w.WriteHeader(http.StatusCreated)
+			fmt.Fprint(w, `{"id":"abc"}`)
+		case "PATCH /uploads/abc":
+			if offset := r.Header.Get("Upload-Offset"); offset != strconv.Itoa(len(received)) {
+				t.Errorf("Wrong offset %s, expected %d", offset, len(received))
+			}
+			patches++
+			if patchStatus != 0 {
+				w.WriteHeader(patchStatus)
+				return
+			}
+			if patches == 2 {
+				// Drop the connection in the middle of the chunk
+				b := make([]byte, 1000)
+				n, _ := io.ReadFull(r.Body, b)
+				received = append(received, b[:n]...)
+				conn, _, _ := w.(http.Hijacker).Hijack()
+				conn.Close()
+				return
+			}
+			b, _ := ioutil.ReadAll(r.Body)
+			received = append(received, b...)
+			w.WriteHeader(http.StatusNoContent)
+		case "HEAD /uploads/abc":
+			w.Header().Set("Upload-Offset", strconv.Itoa(len(received)))
+		case "POST /uploads/abc/complete":
+			w.WriteHeader(http.StatusCreated)
+		case "DELETE /uploads/abc":
+			aborted = true
+			w.WriteHeader(http.StatusNoContent)
+		case "POST /releases/test/1.0.0/test.zip":
+			received, _ = ioutil.ReadAll(r.Body)
+			w.WriteHeader(http.StatusCreated)
+		default:
+			t.Errorf("Wrong request: %s %s", r.Method, r.URL)
+		}
+	}))
+	defer ts.Close()
+
+	c := NewClient(ts.URL, "", "", WithChunkedUpload(1000, 4000))
+	c.retryDelay = 0
+	if err := c.Upload("test", "1.0.0", "test.zip", strings.NewReader(content)); err != nil {
+		t.Fatalf("Chunked upload failed: %s", err)
+	}
+	if string(received) != content {
+		t.Errorf("Wrong content received: %d bytes", len(received))
+	}
+	if patches != 4 {
+		t.Errorf("Expected 4 chunk requests, got %d", patches)
+	}
+
+	// Servers without upload sessions receive a single request
+	sessions = false
+	received = nil
+	if err := c.Upload("test", "1.0.0", "test.zip", strings.NewReader(content)); err != nil {
+		t.Fatalf("Fallback upload failed: %s", err)
+	}
+	if string(received) != content {
+		t.Errorf("Wrong content received by fallback: %d bytes", len(received))
+	}
+
+	// Sessions of files are kept after transient failures to be continued, rejected ones are aborted
+	dir, err := ioutil.TempDir("", "pushrtest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "test.zip")
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	sessions = true
+	for status, abort := range map[int]bool{http.StatusServiceUnavailable: false, http.StatusBadRequest: true} {
+		received = nil
+		patchStatus = status
+		aborted = false
+		if err := c.UploadFile("test", "1.0.0", path); err == nil {
+			t.Errorf("Upload failing with %d succeeded", status)
+		}
+		if aborted != abort {
+			t.Errorf("Upload failing with %d: expected session aborted %t, got %t", status, abort, aborted)
+		}
+	}
+}
+
+func TestSignature(t *testing.T) {
+	pub, key, _ := ed25519.GenerateKey(nil)
+	otherPub, _, _ := ed25519.GenerateKey(nil)
+	sig, err := Sign(key, strings.NewReader("CONTENT"))
+	if err != nil {
+		t.Fatalf("Could not sign: %s", err)
+	}
+	digest := sha512.Sum512([]byte("CONTENT"))
+	if err := VerifySignature([]ed25519.PublicKey{otherPub, pub}, digest[:], sig); err != nil {
+		t.Errorf("Valid signature rejected: %s", err)
+	}
+	if err := VerifySignature([]ed25519.PublicKey{otherPub}, digest[:], sig); err != ErrInvalidSignature {
+		t.Errorf("Signature of untrusted key: expected invalid signature, got %v", err)
+	}
+	other := sha512.Sum512([]byte("OTHER"))
+	if err := VerifySignature([]ed25519.PublicKey{pub}, other[:], sig); err != ErrInvalidSignature {
+		t.Errorf("Signature of other content: expected invalid signature, got %v", err)
+	}
+	if err := VerifySignature([]ed25519.PublicKey{pub}, digest[:], ""); err != ErrUnsigned {
+		t.Errorf("Expected unsigned, got %v", err)
+	}
+
+	// Non seekable readers are buffered, seekers are read from their current offset
+	c := NewClient("", "", "", WithSigningKey(key))
+	r, size, bufferedSig, err := c.sign(io.MultiReader(strings.NewReader("CONTENT")), -1)
+	if b, _ := ioutil.ReadAll(r); err != nil || size != 7 || string(b) != "CONTENT" || bufferedSig != sig {
+		t.Errorf("Signing buffered reader failed: %v %d %q", err, size, b)
+	}
+	sr := strings.NewReader("XXCONTENT")
+	sr.Seek(2, io.SeekStart)
+	r, _, seekerSig, err := c.sign(sr, 7)
+	if b, _ := ioutil.ReadAll(r); err != nil || string(b) != "CONTENT" || seekerSig != sig {
+		t.Errorf("Signing seeker failed: %v %q", err, b)
+	}
+}
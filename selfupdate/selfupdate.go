@@ -0,0 +1,360 @@
+// Package selfupdate replaces the running executable with the latest version of a pushr release.
+//
+// Typical usage in a CLI tool:
+//
+//	u := &selfupdate.Updater{
+//		Client:         pushr.NewClient(host, readToken, ""),
+//		Release:        "mytool",
+//		CurrentVersion: version,
+//	}
+//	newVersion, err := u.Update(ctx)
+//
+// Release files may be plain binaries or tar.gz, gzip or zip archives containing the binary.
+// Platform specific artifacts are preferred over the platform independent file of a version.
+package selfupdate
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/blang/pushr"
+	"github.com/blang/semver"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+var (
+	ErrUpToDate        = errors.New("Already up to date")
+	ErrNoBackup        = errors.New("No backup to roll back to")
+	ErrBinaryNotFound  = errors.New("Binary not found in archive")
+	ErrNoPlatformFiles = errors.New("Version has no file for this platform")
+)
+
+// Updater checks a release for a newer version and replaces the executable with it.
+type Updater struct {
+	Client  *pushr.Client
+	Release string
+	Channel string // Channel of the release, stable if empty
+
+	// CurrentVersion is the semver version of the running binary, a leading v is ignored
+	CurrentVersion string
+
+	// Executable is the path of the binary to replace, the running executable if empty
+	Executable string
+
+	// Binary is the name of the executable inside archives, the base name of Executable if empty
+	Binary string
+
+	// Platform selects the artifact to install, the platform of the running binary if empty
+	Platform pushr.Platform
+}
+
+// Check returns the latest version of the channel if it is newer than CurrentVersion,
+// otherwise ErrUpToDate.
+func (u *Updater) Check(ctx context.Context) (*pushr.ResolvedVersion, error) {
+	current, err := semver.New(strings.TrimPrefix(u.CurrentVersion, "v"))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid current version %q: %s", u.CurrentVersion, err)
+	}
+	version, versionStr, err := u.Client.LatestVersionContext(ctx, u.Release, u.Channel)
+	if err != nil {
+		return nil, err
+	}
+	latest, err := semver.New(versionStr)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid latest version %q: %s", versionStr, err)
+	}
+	if !latest.GT(current) {
+		return nil, ErrUpToDate
+	}
+	return &pushr.ResolvedVersion{Number: versionStr, Version: version}, nil
+}
+
+// Update checks for a newer version and applies it.
+// It returns the installed version or ErrUpToDate.
+func (u *Updater) Update(ctx context.Context) (string, error) {
+	update, err := u.Check(ctx)
+	if err != nil {
+		return "", err
+	}
+	if err := u.Apply(ctx, update); err != nil {
+		return "", err
+	}
+	return update.Number, nil
+}
+
+// Apply downloads and verifies the update, extracts the binary if needed
+// and atomically replaces the executable, keeping the old one as backup for Rollback.
+// On error the executable is left untouched.
+func (u *Updater) Apply(ctx context.Context, update *pushr.ResolvedVersion) error {
+	exe, err := u.executable()
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(exe)
+
+	// Download next to the executable, renames across filesystems are not atomic.
+	// The name is fixed to resume interrupted downloads on the next call.
+	download := filepath.Join(dir, "."+filepath.Base(exe)+".download")
+	defer os.Remove(download)
+
+	platform := u.platform()
+	if _, found := update.Artifacts[platform.Key()]; found {
+		err = u.Client.DownloadPlatformContext(ctx, u.Release, update.Number, platform, download)
+	} else if update.Filename != "" {
+		err = u.Client.DownloadContext(ctx, u.Release, update.Number, download)
+	} else {
+		err = ErrNoPlatformFiles
+	}
+	if err != nil {
+		return err
+	}
+
+	mode := os.FileMode(0755)
+	if fi, err := os.Stat(exe); err == nil {
+		mode = fi.Mode().Perm()
+	}
+	newExe, err := ioutil.TempFile(dir, "."+filepath.Base(exe)+".new")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(newExe.Name())
+	err = u.extract(download, newExe)
+	if err == nil {
+		err = newExe.Sync()
+	}
+	if cerr := newExe.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(newExe.Name(), mode)
+	}
+	if err != nil {
+		return err
+	}
+
+	backup := u.backupPath(exe)
+	os.Remove(backup)
+	if runtime.GOOS == "windows" {
+		// Renaming over the running executable fails on windows, it can only be moved away
+		if err := os.Rename(exe, backup); err != nil {
+			return err
+		}
+		if err := os.Rename(newExe.Name(), exe); err != nil {
+			if rerr := os.Rename(backup, exe); rerr != nil {
+				return fmt.Errorf("Could not restore %s from %s: %s (after %s)", exe, backup, rerr, err)
+			}
+			return err
+		}
+		return nil
+	}
+	// The executable is replaced by a single rename, it never goes missing
+	if err := copyFile(exe, backup); err != nil {
+		return err
+	}
+	return os.Rename(newExe.Name(), exe)
+}
+
+// copyFile creates dst as a hard link of src, or as a copy if linking is not supported.
+func copyFile(src string, dst string) error {
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	fi, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, fi.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(dst)
+	}
+	return err
+}
+
+// Rollback restores the executable replaced by the last Apply.
+func (u *Updater) Rollback() error {
+	exe, err := u.executable()
+	if err != nil {
+		return err
+	}
+	backup := u.backupPath(exe)
+	if _, err := os.Stat(backup); os.IsNotExist(err) {
+		return ErrNoBackup
+	}
+	if runtime.GOOS != "windows" {
+		return os.Rename(backup, exe)
+	}
+	// Renaming over the executable fails on windows, move it away first
+	failed := exe + ".failed"
+	os.Remove(failed)
+	if err := os.Rename(exe, failed); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Rename(backup, exe); err != nil {
+		os.Rename(failed, exe)
+		return err
+	}
+	os.Remove(failed)
+	return nil
+}
+
+// BackupPath returns the path the replaced executable is kept at.
+func (u *Updater) BackupPath() (string, error) {
+	exe, err := u.executable()
+	if err != nil {
+		return "", err
+	}
+	return u.backupPath(exe), nil
+}
+
+func (u *Updater) backupPath(exe string) string {
+	return exe + ".old"
+}
+
+func (u *Updater) executable() (string, error) {
+	if u.Executable != "" {
+		return u.Executable, nil
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	return filepath.EvalSymlinks(exe)
+}
+
+func (u *Updater) platform() pushr.Platform {
+	if u.Platform.OS == "" || u.Platform.Arch == "" {
+		return pushr.CurrentPlatform()
+	}
+	return u.Platform
+}
+
+// binaryNames returns the names matched against archive entries.
+func (u *Updater) binaryNames() []string {
+	name := u.Binary
+	if name == "" {
+		exe, _ := u.executable()
+		name = filepath.Base(exe)
+	}
+	name = strings.TrimSuffix(name, ".exe")
+	if runtime.GOOS == "windows" || u.platform().OS == "windows" {
+		return []string{name + ".exe", name}
+	}
+	return []string{name}
+}
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zipMagic  = []byte("PK\x03\x04")
+)
+
+// extract writes the binary contained in the downloaded file to w.
+// The archive format is detected from the content, the stored filename does not reliably carry it.
+func (u *Updater) extract(path string, w io.Writer) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	br := bufio.NewReader(f)
+	magic, _ := br.Peek(4)
+
+	switch {
+	case bytes.HasPrefix(magic, zipMagic):
+		fi, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		return u.extractZip(f, fi.Size(), w)
+	case bytes.HasPrefix(magic, gzipMagic):
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		gbr := bufio.NewReader(gz)
+		header, _ := gbr.Peek(262)
+		if len(header) == 262 && string(header[257:262]) == "ustar" {
+			return u.extractTar(gbr, w)
+		}
+		_, err = io.Copy(w, gbr)
+		return err
+	default:
+		_, err = io.Copy(w, br)
+		return err
+	}
+}
+
+func (u *Updater) extractTar(r io.Reader, w io.Writer) error {
+	names := u.binaryNames()
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return ErrBinaryNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg || !matchName(hdr.Name, names) {
+			continue
+		}
+		_, err = io.Copy(w, tr)
+		return err
+	}
+}
+
+func (u *Updater) extractZip(r io.ReaderAt, size int64, w io.Writer) error {
+	names := u.binaryNames()
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return err
+	}
+	for _, zf := range zr.File {
+		if !zf.Mode().IsRegular() || !matchName(zf.Name, names) {
+			continue
+		}
+		rc, err := zf.Open()
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+		_, err = io.Copy(w, rc)
+		return err
+	}
+	return ErrBinaryNotFound
+}
+
+func matchName(entry string, names []string) bool {
+	base := filepath.Base(filepath.FromSlash(entry))
+	for _, name := range names {
+		if base == name {
+			return true
+		}
+	}
+	return false
+}
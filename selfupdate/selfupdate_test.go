@@ -0,0 +1,231 @@
+package selfupdate
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/blang/pushr"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func tarGz(t *testing.T, name string, content string) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, f := range []struct{ name, content string }{{"README", "readme"}, {"tool-1.1.0/" + name, content}} {
+		if err := tw.WriteHeader(&tar.Header{Name: f.name, Mode: 0755, Size: int64(len(f.content)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write([]byte(f.content))
+	}
+	tw.Close()
+	gz.Close()
+	return buf.Bytes()
+}
+
+func gzipData(content string) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write([]byte(content))
+	gz.Close()
+	return buf.Bytes()
+}
+
+func zipFile(t *testing.T, name string, content string) []byte {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, f := range []struct{ name, content string }{{"README", "readme"}, {name, content}} {
+		w, err := zw.Create(f.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(f.content))
+	}
+	zw.Close()
+	return buf.Bytes()
+}
+
+// newReleaseServer serves version 1.1.0 of release tool with the given file and platform artifacts.
+func newReleaseServer(t *testing.T, file []byte, artifacts map[string][]byte) *httptest.Server {
+	digest := func(b []byte) string {
+		sum := sha256.Sum256(b)
+		return pushr.DigestHeader(hex.EncodeToString(sum[:]), "")
+	}
+	version := &pushr.Version{Artifacts: make(map[string]*pushr.Artifact)}
+	if file != nil {
+		version.Filename = "tool-1.1.0.bin"
+	}
+	for key := range artifacts {
+		version.Artifacts[key] = &pushr.Artifact{}
+	}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/releases/tool/latest":
+			json.NewEncoder(w).Encode(&pushr.ResolvedVersion{Number: "1.1.0", Version: version})
+			return
+		case "/releases/tool/1.1.0":
+			if file != nil {
+				w.Header().Set("Digest", digest(file))
+				w.Write(file)
+				return
+			}
+		default:
+			for key, b := range artifacts {
+				if r.URL.Path == "/releases/tool/1.1.0/"+key {
+					w.Header().Set("Digest", digest(b))
+					w.Write(b)
+					return
+				}
+			}
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+}
+
+func newExecutable(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "pushrselfupdate")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %s", err)
+	}
+	exe := filepath.Join(dir, "tool")
+	if err := ioutil.WriteFile(exe, []byte("OLD"), 0755); err != nil {
+		t.Fatalf("Could not write executable: %s", err)
+	}
+	return exe, func() { os.RemoveAll(dir) }
+}
+
+func readFile(t *testing.T, path string) string {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Could not read %s: %s", path, err)
+	}
+	return string(b)
+}
+
+func TestUpdate(t *testing.T) {
+	platform := pushr.Platform{OS: "linux", Arch: "amd64"}
+	tests := map[string]struct {
+		file      []byte
+		artifacts map[string][]byte
+	}{
+		"plain":    {file: []byte("NEW")},
+		"gzip":     {file: gzipData("NEW")},
+		"tar.gz":   {file: tarGz(t, "tool", "NEW")},
+		"zip":      {file: zipFile(t, "tool", "NEW")},
+		"artifact": {file: []byte("GENERIC"), artifacts: map[string][]byte{"linux/amd64": tarGz(t, "tool", "NEW"), "darwin/amd64": []byte("DARWIN")}},
+	}
+	for name, test := range tests {
+		ts := newReleaseServer(t, test.file, test.artifacts)
+		exe, cleanup := newExecutable(t)
+
+		u := &Updater{
+			Client:         pushr.NewClient(ts.URL, "", ""),
+			Release:        "tool",
+			CurrentVersion: "v1.0.0",
+			Executable:     exe,
+			Platform:       platform,
+		}
+		newVersion, err := u.Update(context.Background())
+		if err != nil || newVersion != "1.1.0" {
+			t.Errorf("%s: Update failed: %s %v", name, newVersion, err)
+		} else if content := readFile(t, exe); content != "NEW" {
+			t.Errorf("%s: Wrong executable after update: %q", name, content)
+		} else if fi, _ := os.Stat(exe); fi.Mode().Perm() != 0755 {
+			t.Errorf("%s: Executable mode not kept: %s", name, fi.Mode())
+		} else if backup, _ := u.BackupPath(); readFile(t, backup) != "OLD" {
+			t.Errorf("%s: Wrong backup", name)
+		}
+		if files, _ := ioutil.ReadDir(filepath.Dir(exe)); len(files) != 2 {
+			t.Errorf("%s: Temp files left: %d files", name, len(files))
+		}
+
+		ts.Close()
+		cleanup()
+	}
+}
+
+func TestUpToDateAndRollback(t *testing.T) {
+	ts := newReleaseServer(t, []byte("NEW"), nil)
+	defer ts.Close()
+	exe, cleanup := newExecutable(t)
+	defer cleanup()
+
+	u := &Updater{
+		Client:         pushr.NewClient(ts.URL, "", ""),
+		Release:        "tool",
+		CurrentVersion: "1.1.0",
+		Executable:     exe,
+	}
+	if _, err := u.Update(context.Background()); err != ErrUpToDate {
+		t.Fatalf("Expected up to date error, got %v", err)
+	}
+	if err := u.Rollback(); err != ErrNoBackup {
+		t.Fatalf("Expected no backup error, got %v", err)
+	}
+
+	u.CurrentVersion = "1.0.0"
+	if _, err := u.Update(context.Background()); err != nil {
+		t.Fatalf("Update failed: %s", err)
+	}
+	if err := u.Rollback(); err != nil {
+		t.Fatalf("Rollback failed: %s", err)
+	}
+	if content := readFile(t, exe); content != "OLD" {
+		t.Errorf("Wrong executable after rollback: %q", content)
+	}
+	if err := u.Rollback(); err != ErrNoBackup {
+		t.Errorf("Expected no backup error after rollback, got %v", err)
+	}
+}
+
+func TestUpdateFailureKeepsExecutable(t *testing.T) {
+	exe, cleanup := newExecutable(t)
+	defer cleanup()
+
+	// Archive without binary
+	ts := newReleaseServer(t, tarGz(t, "other", "NEW"), nil)
+	defer ts.Close()
+	u := &Updater{
+		Client:         pushr.NewClient(ts.URL, "", ""),
+		Release:        "tool",
+		CurrentVersion: "1.0.0",
+		Executable:     exe,
+	}
+	if _, err := u.Update(context.Background()); err != ErrBinaryNotFound {
+		t.Errorf("Expected binary not found error, got %v", err)
+	}
+
+	// Corrupt download
+	ts2 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/releases/tool/latest" {
+			json.NewEncoder(w).Encode(&pushr.ResolvedVersion{Number: "1.1.0", Version: &pushr.Version{Filename: "tool-1.1.0.bin"}})
+			return
+		}
+		w.Header().Set("Digest", pushr.DigestHeader(hex.EncodeToString(make([]byte, 32)), ""))
+		w.Write([]byte("NEW"))
+	}))
+	defer ts2.Close()
+	u.Client = pushr.NewClient(ts2.URL, "", "")
+	var checksumErr *pushr.ChecksumError
+	if _, err := u.Update(context.Background()); !errors.As(err, &checksumErr) {
+		t.Errorf("Expected checksum error, got %v", err)
+	}
+
+	if content := readFile(t, exe); content != "OLD" {
+		t.Errorf("Executable changed by failed update: %q", content)
+	}
+	if files, _ := ioutil.ReadDir(filepath.Dir(exe)); len(files) != 1 {
+		t.Errorf("Files left after failed update: %d files", len(files))
+	}
+}
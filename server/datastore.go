@@ -0,0 +1,532 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/blang/pushr"
+	"github.com/blang/semver"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Name of the metadata index inside the data directory
+const indexFilename = "index.json"
+
+type DataStore struct {
+	sync.RWMutex
+	storage  Storage
+	releases map[string]*pushr.Release
+	pending  map[string]bool // Versions reserved by running uploads
+}
+
+// index is the persisted form of the DataStore metadata
+type index struct {
+	Releases map[string]*pushr.Release `json:"releases"`
+}
+
+// loadDataStore reads the metadata index from storage.
+// If there is no index yet, it is built once from the stored files.
+func loadDataStore(storage Storage) (*DataStore, error) {
+	ds := &DataStore{
+		storage:  storage,
+		releases: make(map[string]*pushr.Release),
+		pending:  make(map[string]bool),
+	}
+	f, err := storage.Get(indexFilename)
+	if os.IsNotExist(err) {
+		log.Printf("No metadata index found, importing existing files\n")
+		if err := ds.migrate(); err != nil {
+			return nil, err
+		}
+		if err := ds.save(); err != nil {
+			return nil, err
+		}
+		return ds, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var idx index
+	if err := json.NewDecoder(f).Decode(&idx); err != nil {
+		return nil, fmt.Errorf("Could not read metadata index: %s", err)
+	}
+	if idx.Releases != nil {
+		ds.releases = idx.Releases
+	}
+	for name, r := range ds.releases {
+		if r.Versions == nil {
+			r.Versions = make(map[string]*pushr.Version)
+		}
+		log.Printf("Loaded release %q with %d versions", name, len(r.Versions))
+	}
+	return ds, nil
+}
+
+// Version returns a copy of the version metadata, safe to use without holding the lock.
+func (d *DataStore) Version(name string, versionStr string) (*pushr.Version, bool) {
+	d.RLock()
+	defer d.RUnlock()
+	release, found := d.releases[name]
+	if !found {
+		return nil, false
+	}
+	version, found := release.Versions[versionStr]
+	if !found {
+		return nil, false
+	}
+	return copyVersion(version), true
+}
+
+// copyVersion returns a deep copy of version.
+// The caller must hold the lock.
+func copyVersion(version *pushr.Version) *pushr.Version {
+	v := *version
+	if version.Artifacts != nil {
+		v.Artifacts = make(map[string]*pushr.Artifact, len(version.Artifacts))
+		for key, artifact := range version.Artifacts {
+			a := *artifact
+			v.Artifacts[key] = &a
+		}
+	}
+	return &v
+}
+
+func reservationKey(name string, versionStr string, artifactKey string) string {
+	if artifactKey == "" {
+		return name + "/" + versionStr
+	}
+	return name + "/" + versionStr + "/" + artifactKey
+}
+
+// usage returns the number and total size of the stored files of all releases.
+func (d *DataStore) usage() (files int, size int64) {
+	d.RLock()
+	defer d.RUnlock()
+	for _, release := range d.releases {
+		for _, version := range release.Versions {
+			if version.Filename != "" {
+				files++
+				size += version.Size
+			}
+			for _, artifact := range version.Artifacts {
+				files++
+				size += artifact.Size
+			}
+		}
+	}
+	return files, size
+}
+
+// reserve marks a version, or the artifact of a version if artifactKey is not empty, as being uploaded.
+// It returns false if the file already exists or is reserved by another upload.
+func (d *DataStore) reserve(name string, versionStr string, artifactKey string) bool {
+	d.Lock()
+	defer d.Unlock()
+	key := reservationKey(name, versionStr, artifactKey)
+	if d.pending[key] {
+		return false
+	}
+	if release, found := d.releases[name]; found {
+		if version, found := release.Versions[versionStr]; found {
+			if artifactKey == "" && version.Filename != "" {
+				return false
+			}
+			if _, found := version.Artifacts[artifactKey]; artifactKey != "" && found {
+				return false
+			}
+		}
+	}
+	d.pending[key] = true
+	return true
+}
+
+// unreserve removes the reservation of reserve.
+func (d *DataStore) unreserve(name string, versionStr string, artifactKey string) {
+	d.Lock()
+	defer d.Unlock()
+	delete(d.pending, reservationKey(name, versionStr, artifactKey))
+}
+
+// commit adds an uploaded version and persists the metadata.
+// Artifacts uploaded before the version file are kept.
+func (d *DataStore) commit(name string, versionStr string, version *pushr.Version) error {
+	return d.update(name, versionStr, func(existing *pushr.Version) *pushr.Version {
+		if existing != nil {
+			version.Artifacts = existing.Artifacts
+			version.Yanked = existing.Yanked
+		}
+		return version
+	})
+}
+
+// commitArtifact adds an uploaded artifact and persists the metadata.
+// The version is created if it does not exist yet.
+func (d *DataStore) commitArtifact(name string, versionStr string, artifact *pushr.Artifact) error {
+	return d.update(name, versionStr, func(existing *pushr.Version) *pushr.Version {
+		version := pushr.NewVersion()
+		if existing != nil {
+			version = copyVersion(existing)
+		} else {
+			version.Uploaded = artifact.Uploaded
+		}
+		if version.Artifacts == nil {
+			version.Artifacts = make(map[string]*pushr.Artifact)
+		}
+		version.Artifacts[artifact.Key()] = artifact
+		return version
+	})
+}
+
+// update replaces a version by the result of fn and persists the metadata, restoring the old state on error.
+func (d *DataStore) update(name string, versionStr string, fn func(existing *pushr.Version) *pushr.Version) error {
+	d.Lock()
+	defer d.Unlock()
+	release, found := d.releases[name]
+	if !found {
+		release = pushr.NewRelease()
+		d.releases[name] = release
+	}
+	existing := release.Versions[versionStr]
+	release.Versions[versionStr] = fn(existing)
+	if err := d.save(); err != nil {
+		if existing != nil {
+			release.Versions[versionStr] = existing
+		} else {
+			delete(release.Versions, versionStr)
+		}
+		if len(release.Versions) == 0 && len(release.Channels) == 0 {
+			delete(d.releases, name)
+		}
+		return err
+	}
+	return nil
+}
+
+var (
+	errVersionNotFound = errors.New("Version not found")
+	errVersionPromoted = errors.New("Version is the current version of a channel, promote another version or remove the channel first")
+)
+
+// delete removes a version from the metadata and deletes its file.
+// Versions channels point to are not deleted. Releases are kept while they have channels,
+// the promotion history must survive the deletion of all versions.
+func (d *DataStore) delete(name string, versionStr string) error {
+	d.Lock()
+	defer d.Unlock()
+	release, found := d.releases[name]
+	if !found {
+		return errVersionNotFound
+	}
+	version, found := release.Versions[versionStr]
+	if !found {
+		return errVersionNotFound
+	}
+	for _, c := range release.Channels {
+		if c.Version == versionStr {
+			return errVersionPromoted
+		}
+	}
+	delete(release.Versions, versionStr)
+	if len(release.Versions) == 0 && len(release.Channels) == 0 {
+		delete(d.releases, name)
+	}
+	if err := d.save(); err != nil {
+		release.Versions[versionStr] = version
+		d.releases[name] = release
+		return err
+	}
+	// The version is gone from the metadata, left over files are harmless
+	filenames := []string{version.Filename}
+	for _, artifact := range version.Artifacts {
+		filenames = append(filenames, artifact.Filename)
+	}
+	for _, filename := range filenames {
+		if filename == "" {
+			continue
+		}
+		if err := d.storage.Delete(filename); err != nil {
+			log.Printf("Could not delete file %s: %s\n", filename, err)
+		}
+	}
+	return nil
+}
+
+// setYanked marks a version as yanked or restores it.
+func (d *DataStore) setYanked(name string, versionStr string, yanked bool) error {
+	d.Lock()
+	defer d.Unlock()
+	release, found := d.releases[name]
+	if !found {
+		return errVersionNotFound
+	}
+	version, found := release.Versions[versionStr]
+	if !found {
+		return errVersionNotFound
+	}
+	if version.Yanked == yanked {
+		return nil
+	}
+	version.Yanked = yanked
+	if err := d.save(); err != nil {
+		version.Yanked = !yanked
+		return err
+	}
+	return nil
+}
+
+var errVersionYanked = errors.New("Version is yanked")
+
+// Number of promotions kept in the history of a channel
+const maxChannelHistory = 100
+
+// promote points channel to an existing, not yanked version and records the promotion in the channel history.
+func (d *DataStore) promote(name string, channel string, versionStr string, remote string) error {
+	d.Lock()
+	defer d.Unlock()
+	release, found := d.releases[name]
+	if !found {
+		return errVersionNotFound
+	}
+	version, found := release.Versions[versionStr]
+	if !found {
+		return errVersionNotFound
+	}
+	if version.Yanked {
+		return errVersionYanked
+	}
+
+	existing := release.Channels[channel]
+	c := &pushr.Channel{}
+	promotion := &pushr.Promotion{
+		Version:  versionStr,
+		Promoted: time.Now().UTC(),
+		Remote:   remote,
+	}
+	if existing != nil {
+		promotion.Previous = existing.Version
+		c.History = append(c.History, existing.History...)
+	}
+	c.Version = versionStr
+	c.Promoted = promotion.Promoted
+	c.History = append(c.History, promotion)
+	if len(c.History) > maxChannelHistory {
+		c.History = c.History[len(c.History)-maxChannelHistory:]
+	}
+
+	if release.Channels == nil {
+		release.Channels = make(map[string]*pushr.Channel)
+	}
+	release.Channels[channel] = c
+	if err := d.save(); err != nil {
+		if existing != nil {
+			release.Channels[channel] = existing
+		} else {
+			delete(release.Channels, channel)
+		}
+		return err
+	}
+	log.Printf("Promoted %s %s to channel %q (previous: %q, remote: %s)\n", name, versionStr, channel, promotion.Previous, remote)
+	return nil
+}
+
+var errChannelNotFound = errors.New("Channel not found")
+
+// unpromote removes the version pointer of channel and records the removal in the channel history.
+// The channel is kept with an empty version, the history must survive. It returns the previous version.
+func (d *DataStore) unpromote(name string, channel string, remote string) (string, error) {
+	d.Lock()
+	defer d.Unlock()
+	release, found := d.releases[name]
+	if !found {
+		return "", errChannelNotFound
+	}
+	existing, found := release.Channels[channel]
+	if !found || existing.Version == "" {
+		return "", errChannelNotFound
+	}
+
+	promotion := &pushr.Promotion{
+		Previous: existing.Version,
+		Promoted: time.Now().UTC(),
+		Remote:   remote,
+	}
+	c := &pushr.Channel{
+		Promoted: promotion.Promoted,
+		History:  append(append([]*pushr.Promotion(nil), existing.History...), promotion),
+	}
+	if len(c.History) > maxChannelHistory {
+		c.History = c.History[len(c.History)-maxChannelHistory:]
+	}
+	release.Channels[channel] = c
+	if err := d.save(); err != nil {
+		release.Channels[channel] = existing
+		return "", err
+	}
+	log.Printf("Removed channel %q of %s (previous: %q, remote: %s)\n", channel, name, promotion.Previous, remote)
+	return promotion.Previous, nil
+}
+
+// Channel returns a copy of a channel pointer including its history.
+func (d *DataStore) Channel(name string, channel string) (*pushr.Channel, bool) {
+	d.RLock()
+	defer d.RUnlock()
+	release, found := d.releases[name]
+	if !found {
+		return nil, false
+	}
+	c, found := release.Channels[channel]
+	if !found {
+		return nil, false
+	}
+	cp := *c
+	cp.History = make([]*pushr.Promotion, len(c.History))
+	for i, p := range c.History {
+		promotion := *p
+		cp.History[i] = &promotion
+	}
+	return &cp, true
+}
+
+// save atomically writes the metadata index.
+// The caller must hold the write lock.
+func (d *DataStore) save() error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetIndent("", "\t")
+	if err := enc.Encode(&index{Releases: d.releases}); err != nil {
+		return err
+	}
+	_, err := d.storage.Put(indexFilename, &buf)
+	return err
+}
+
+// migrate imports a data directory laid out as name-version.ext files,
+// including the checksum files written by older versions.
+func (d *DataStore) migrate() error {
+	files, err := d.storage.List()
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if isChecksumFile(f.Name) || f.Name == indexFilename || f.Name == statsFilename {
+			continue
+		}
+		name, versionStr, ext, ok := parseFilename(f.Name)
+		if !ok {
+			log.Printf("Could not parse filename %s\n", f.Name)
+			continue
+		}
+		//TODO: Check filename for invalid chars
+
+		r, found := d.releases[name]
+		if !found {
+			r = pushr.NewRelease()
+			d.releases[name] = r
+		}
+
+		_, found = r.Versions[versionStr]
+		if found {
+			log.Printf("Duplicate version of file %s: %s\n", f.Name, versionStr)
+			continue
+		}
+		v := pushr.NewVersion()
+		v.Size = f.Size
+		v.ContentType = mime.TypeByExtension(ext)
+		v.Filename = f.Name
+		v.Uploaded = f.ModTime.UTC()
+		if err := d.readChecksums(v); err != nil {
+			log.Printf("Could not read checksums of file %s: %s\n", f.Name, err)
+			continue
+		}
+		r.Versions[versionStr] = v
+		log.Printf("Imported %s: Release %q, Version: %q, Content-Type: %q, Size: %dB", f.Name, name, versionStr, v.ContentType, v.Size)
+	}
+	return nil
+}
+
+// parseFilename splits a filename of the form name-version.ext.
+// The release name may contain dashes, the first split yielding a valid semver version wins.
+func parseFilename(filename string) (name string, versionStr string, ext string, ok bool) {
+	ext = filepath.Ext(filename)
+	if ext == "" {
+		return "", "", "", false
+	}
+	base := strings.TrimSuffix(filename, ext)
+	for i := 0; i < len(base); i++ {
+		if base[i] != '-' || i == 0 {
+			continue
+		}
+		if _, err := semver.New(base[i+1:]); err == nil {
+			return base[:i], base[i+1:], ext, true
+		}
+	}
+	return "", "", "", false
+}
+
+var checksumExts = []string{".sha256", ".sha512"}
+
+func isChecksumFile(name string) bool {
+	for _, ext := range checksumExts {
+		if strings.HasSuffix(name, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// readChecksums loads the checksum files of older data directories into version.
+// If there is no SHA-256 checksum file, the file is hashed.
+func (d *DataStore) readChecksums(version *pushr.Version) error {
+	sums := []*string{&version.SHA256, &version.SHA512}
+	for i, ext := range checksumExts {
+		b, err := d.readFile(version.Filename + ext)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		fields := strings.Fields(string(b))
+		if len(fields) == 0 {
+			return fmt.Errorf("Empty checksum file %s", version.Filename+ext)
+		}
+		*sums[i] = fields[0]
+	}
+	if version.SHA256 != "" {
+		return nil
+	}
+
+	f, err := d.storage.Get(version.Filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	version.SHA256 = hex.EncodeToString(h.Sum(nil))
+	return nil
+}
+
+func (d *DataStore) readFile(name string) ([]byte, error) {
+	f, err := d.storage.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ioutil.ReadAll(f)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseFilename(t *testing.T) {
+	tests := []struct {
+		filename string
+		name     string
+		version  string
+		ext      string
+		ok       bool
+	}{
+		{"test-1.0.0.zip", "test", "1.0.0", ".zip", true},
+		{"my-app-1.0.0.zip", "my-app", "1.0.0", ".zip", true},
+		{"my-app-1.0.1-beta.1.tar", "my-app", "1.0.1-beta.1", ".tar", true},
+		{"test-1.0.0", "", "", "", false},
+		{"test.zip", "", "", "", false},
+		{"-1.0.0.zip", "", "", "", false},
+	}
+	for _, test := range tests {
+		name, version, ext, ok := parseFilename(test.filename)
+		if name != test.name || version != test.version || ext != test.ext || ok != test.ok {
+			t.Errorf("parseFilename(%q): expected %q %q %q %t, got %q %q %q %t", test.filename, test.name, test.version, test.ext, test.ok, name, version, ext, ok)
+		}
+	}
+}
+
+func TestDataStoreMigration(t *testing.T) {
+	dataDir, err := ioutil.TempDir("", "pushrtest")
+	if err != nil {
+		t.Fatalf("Could not create test data dir: %s", err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	files := map[string]string{
+		"my-app-1.0.0.zip":        "TESTOUTPUT",
+		"my-app-1.0.0.zip.sha256": "0123456789abcdef  my-app-1.0.0.zip\n",
+		"my-app-1.1.0-beta.zip":   "TESTOUTPUT",
+		"invalid.zip":             "TESTOUTPUT",
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dataDir, name), []byte(content), 0600); err != nil {
+			t.Fatalf("Could not write test file: %s", err)
+		}
+	}
+
+	st, err := newFSStorage(dataDir)
+	if err != nil {
+		t.Fatalf("Could not create storage: %s", err)
+	}
+	ds, err := loadDataStore(st)
+	if err != nil {
+		t.Fatalf("Could not load data store: %s", err)
+	}
+	r, found := ds.releases["my-app"]
+	if !found || len(ds.releases) != 1 {
+		t.Fatalf("Expected release my-app only, got %v", ds.releases)
+	}
+	if len(r.Versions) != 2 {
+		t.Fatalf("Expected 2 versions, got %d", len(r.Versions))
+	}
+	v := r.Versions["1.0.0"]
+	if v == nil || v.SHA256 != "0123456789abcdef" || v.Size != 10 || v.Filename != "my-app-1.0.0.zip" {
+		t.Errorf("Wrong imported version: %v", v)
+	}
+	if v := r.Versions["1.1.0-beta"]; v == nil || v.SHA256 == "" {
+		t.Errorf("Checksum of version without checksum file not computed: %v", v)
+	}
+
+	// Metadata is read from the index after the migration
+	os.Remove(filepath.Join(dataDir, "my-app-1.0.0.zip.sha256"))
+	ds.releases["my-app"].Versions["1.0.0"].Notes = "Persisted"
+	if err := ds.save(); err != nil {
+		t.Fatalf("Could not save data store: %s", err)
+	}
+	ds, err = loadDataStore(st)
+	if err != nil {
+		t.Fatalf("Could not reload data store: %s", err)
+	}
+	v = ds.releases["my-app"].Versions["1.0.0"]
+	if v == nil || v.SHA256 != "0123456789abcdef" || v.Notes != "Persisted" {
+		t.Errorf("Wrong reloaded version: %v", v)
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/blang/pushr"
+	"github.com/gorilla/mux"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// Number of events per release replayed to streams reconnecting with Last-Event-ID
+	maxRecentEvents = 100
+
+	// Number of events buffered per stream, slower streams are disconnected and resume by reconnecting
+	eventBufferSize = 16
+
+	// Interval of comments sent on idle streams, keeping proxies from closing the connection
+	eventKeepAlive = 30 * time.Second
+
+	// Maximum duration a release listing waits for a change
+	maxListingWait = 5 * time.Minute
+)
+
+// eventBroker passes release events to the event streams and waiting release listings.
+type eventBroker struct {
+	sync.Mutex
+	subscribers map[string]map[chan *pushr.Event]bool // By release
+	recent      map[string][]*pushr.Event             // By release, oldest first
+	closed      bool
+}
+
+func newEventBroker() *eventBroker {
+	return &eventBroker{
+		subscribers: make(map[string]map[chan *pushr.Event]bool),
+		recent:      make(map[string][]*pushr.Event),
+	}
+}
+
+// subscribe returns a channel receiving the events of release and the recent events after lastID.
+// No events are replayed if lastID is empty or unknown. The channel is closed if the broker is closed
+// or the subscriber falls behind.
+func (b *eventBroker) subscribe(release string, lastID string) (chan *pushr.Event, []*pushr.Event) {
+	b.Lock()
+	defer b.Unlock()
+	ch := make(chan *pushr.Event, eventBufferSize)
+	if b.closed {
+		close(ch)
+		return ch, nil
+	}
+	if b.subscribers[release] == nil {
+		b.subscribers[release] = make(map[chan *pushr.Event]bool)
+	}
+	b.subscribers[release][ch] = true
+
+	var replay []*pushr.Event
+	if lastID != "" {
+		recent := b.recent[release]
+		for i, event := range recent {
+			if event.ID == lastID {
+				replay = append(replay, recent[i+1:]...)
+				break
+			}
+		}
+	}
+	return ch, replay
+}
+
+func (b *eventBroker) unsubscribe(release string, ch chan *pushr.Event) {
+	b.Lock()
+	defer b.Unlock()
+	if b.subscribers[release][ch] {
+		delete(b.subscribers[release], ch)
+		close(ch)
+	}
+	if len(b.subscribers[release]) == 0 {
+		delete(b.subscribers, release)
+	}
+}
+
+// broadcast passes event to the subscribers of its release without blocking.
+func (b *eventBroker) broadcast(event *pushr.Event) {
+	b.Lock()
+	defer b.Unlock()
+	recent := append(b.recent[event.Release], event)
+	if len(recent) > maxRecentEvents {
+		recent = append([]*pushr.Event(nil), recent[len(recent)-maxRecentEvents:]...)
+	}
+	b.recent[event.Release] = recent
+	for ch := range b.subscribers[event.Release] {
+		select {
+		case ch <- event:
+		default:
+			delete(b.subscribers[event.Release], ch)
+			close(ch)
+		}
+	}
+}
+
+// close ends all subscriptions, used on shutdown as streams would keep the server from finishing requests.
+func (b *eventBroker) close() {
+	b.Lock()
+	defer b.Unlock()
+	b.closed = true
+	for _, subscribers := range b.subscribers {
+		for ch := range subscribers {
+			close(ch)
+		}
+	}
+	b.subscribers = make(map[string]map[chan *pushr.Event]bool)
+}
+
+// writeEvent writes event in the Server-Sent Events format.
+func writeEvent(w http.ResponseWriter, event *pushr.Event) error {
+	b, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	if event.ID != "" {
+		fmt.Fprintf(w, "id: %s\n", event.ID)
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, b)
+	return err
+}
+
+// latestEvent returns a latest event of channel if its latest version differs from previous.
+func (a *RestAPI) latestEvent(name string, channel string, previous string, cause *pushr.Event) *pushr.Event {
+	a.ds.RLock()
+	defer a.ds.RUnlock()
+	release, found := a.ds.releases[name]
+	if !found {
+		return nil
+	}
+	version, versionStr, err := release.Latest(channel)
+	if err != nil || versionStr == previous {
+		return nil
+	}
+	event := &pushr.Event{
+		Type:     pushr.EventLatest,
+		Release:  name,
+		Version:  versionStr,
+		Channel:  channel,
+		Time:     time.Now().UTC(),
+		Metadata: copyVersion(version),
+	}
+	if cause != nil {
+		event.ID = cause.ID
+		event.Time = cause.Time
+	}
+	return event
+}
+
+// handleReleaseEvents streams the events of a release as Server-Sent Events.
+// With the channel query parameter only latest events are sent, starting with the current latest version
+// of the channel and followed by every change of it.
+func (a *RestAPI) handleReleaseEvents(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, "Error: Streaming not supported")
+		return
+	}
+	a.ds.RLock()
+	_, found := a.ds.releases[name]
+	a.ds.RUnlock()
+	if !found {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	_, latestOnly := r.URL.Query()["channel"]
+	channel := r.URL.Query().Get("channel")
+
+	events, replay := a.events.subscribe(name, r.Header.Get("Last-Event-ID"))
+	defer a.events.unsubscribe(name, events)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	latest := ""
+	if latestOnly {
+		if event := a.latestEvent(name, channel, latest, nil); event != nil {
+			latest = event.Version
+			writeEvent(w, event)
+		}
+	} else {
+		for _, event := range replay {
+			writeEvent(w, event)
+		}
+	}
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			if latestOnly {
+				if event = a.latestEvent(name, channel, latest, event); event == nil {
+					continue
+				}
+				latest = event.Version
+			}
+			if err := writeEvent(w, event); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
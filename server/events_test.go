@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"github.com/blang/pushr"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readStreamEvent reads the next event of a Server-Sent Events stream.
+func readStreamEvent(t *testing.T, br *bufio.Reader) *pushr.Event {
+	var event *pushr.Event
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Stream ended: %s", err)
+		}
+		if strings.HasPrefix(line, "data: ") {
+			event = &pushr.Event{}
+			if err := json.Unmarshal([]byte(line[len("data: "):]), event); err != nil {
+				t.Fatalf("Invalid event %q: %s", line, err)
+			}
+		} else if line == "\n" && event != nil {
+			return event
+		}
+	}
+}
+
+func TestReleaseEvents(t *testing.T) {
+	_, ts, cleanup := newTestServer(t)
+	defer cleanup()
+
+	if resp := upload(t, ts.URL+"/releases/test/1.0.0/test.zip", strings.NewReader("TESTOUTPUT")); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Upload failed with status %d", resp.StatusCode)
+	}
+	if resp, err := http.Get(ts.URL + "/releases/unknown/events"); err != nil {
+		t.Fatal(err)
+	} else if resp.Body.Close(); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Events of unknown release returned %d", resp.StatusCode)
+	}
+
+	resp, err := http.Get(ts.URL + "/releases/test/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Errorf("Wrong content type %s", resp.Header.Get("Content-Type"))
+	}
+	br := bufio.NewReader(resp.Body)
+	c := pushr.NewClient(ts.URL, "", "")
+	if resp := upload(t, ts.URL+"/releases/test/1.1.0/test.zip", strings.NewReader("TESTOUTPUT")); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Upload failed with status %d", resp.StatusCode)
+	}
+	if err := c.Yank("test", "1.1.0"); err != nil {
+		t.Fatalf("Yank failed: %s", err)
+	}
+	uploaded := readStreamEvent(t, br)
+	if uploaded.Type != pushr.EventUpload || uploaded.Version != "1.1.0" || uploaded.Metadata == nil {
+		t.Errorf("Wrong upload event %v", uploaded)
+	}
+	if e := readStreamEvent(t, br); e.Type != pushr.EventYank || e.Version != "1.1.0" {
+		t.Errorf("Wrong yank event %v", e)
+	}
+	resp.Body.Close()
+
+	// Reconnecting streams get the events they missed
+	req, _ := http.NewRequest("GET", ts.URL+"/releases/test/events", nil)
+	req.Header.Set("Last-Event-ID", uploaded.ID)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if e := readStreamEvent(t, bufio.NewReader(resp.Body)); e.Type != pushr.EventYank {
+		t.Errorf("Missed event not replayed: %v", e)
+	}
+
+	// Streams of a channel send its latest version
+	resp, err = http.Get(ts.URL + "/releases/test/events?channel=")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	br = bufio.NewReader(resp.Body)
+	if e := readStreamEvent(t, br); e.Type != pushr.EventLatest || e.Version != "1.0.0" || e.Channel != "" {
+		t.Errorf("Wrong initial latest event %v", e)
+	}
+	if err := c.Unyank("test", "1.1.0"); err != nil {
+		t.Fatalf("Unyank failed: %s", err)
+	}
+	if e := readStreamEvent(t, br); e.Type != pushr.EventLatest || e.Version != "1.1.0" || e.Metadata == nil {
+		t.Errorf("Wrong latest event %v", e)
+	}
+}
+
+func TestReleaseListingWait(t *testing.T) {
+	_, ts, cleanup := newTestServer(t)
+	defer cleanup()
+
+	if resp := upload(t, ts.URL+"/releases/test/1.0.0/test.zip", strings.NewReader("TESTOUTPUT")); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Upload failed with status %d", resp.StatusCode)
+	}
+	list := func(query string, etag string) (*http.Response, string) {
+		req, _ := http.NewRequest("GET", ts.URL+"/releases/test"+query, nil)
+		req.Header.Set("If-None-Match", etag)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp, string(b)
+	}
+	resp, _ := list("", "")
+	etag := resp.Header.Get("ETag")
+	if resp.StatusCode != http.StatusOK || etag == "" {
+		t.Fatalf("Listing returned %d with ETag %q", resp.StatusCode, etag)
+	}
+	if resp, _ := list("", etag); resp.StatusCode != http.StatusNotModified {
+		t.Errorf("Unchanged listing returned %d", resp.StatusCode)
+	}
+	start := time.Now()
+	if resp, _ := list("?wait=50ms", etag); resp.StatusCode != http.StatusNotModified || time.Since(start) < 50*time.Millisecond {
+		t.Errorf("Waiting for unchanged listing returned %d after %s", resp.StatusCode, time.Since(start))
+	}
+	if resp, _ := list("?wait=soon", etag); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Invalid wait returned %d", resp.StatusCode)
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		if resp, err := http.Post(ts.URL+"/releases/test/1.1.0/test.zip", "application/octet-stream", strings.NewReader("TESTOUTPUT")); err == nil {
+			resp.Body.Close()
+		}
+	}()
+	start = time.Now()
+	resp, body := list("?wait=1m", etag)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(body, "1.1.0") || resp.Header.Get("ETag") == etag {
+		t.Errorf("Changed listing returned %d with %s", resp.StatusCode, body)
+	}
+	if time.Since(start) > 10*time.Second {
+		t.Errorf("Listing returned after %s, not on change", time.Since(start))
+	}
+}
+
+func TestWatch(t *testing.T) {
+	_, ts, cleanup := newTestServer(t)
+	defer cleanup()
+
+	for _, v := range []string{"1.0.0", "1.1.0-beta.1"} {
+		if resp := upload(t, ts.URL+"/releases/test/"+v+"/test.zip", strings.NewReader("TESTOUTPUT")); resp.StatusCode != http.StatusCreated {
+			t.Fatalf("Upload failed with status %d", resp.StatusCode)
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := pushr.NewClient(ts.URL, "", "")
+	if _, err := c.Watch(ctx, "unknown", ""); err == nil {
+		t.Errorf("Watch of unknown release succeeded")
+	}
+	events, err := c.Watch(ctx, "test", "stable")
+	if err != nil {
+		t.Fatalf("Watch failed: %s", err)
+	}
+	next := func() *pushr.Event {
+		select {
+		case e := <-events:
+			return e
+		case <-time.After(10 * time.Second):
+			t.Fatal("No event received")
+		}
+		return nil
+	}
+	if e := next(); e.Version != "1.0.0" {
+		t.Errorf("Wrong initial latest version %v", e)
+	}
+	// Prereleases do not change the stable channel
+	if resp := upload(t, ts.URL+"/releases/test/1.2.0-beta.1/test.zip", strings.NewReader("TESTOUTPUT")); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Upload failed with status %d", resp.StatusCode)
+	}
+	if err := c.Promote("test", "stable", "1.1.0-beta.1"); err != nil {
+		t.Fatalf("Promote failed: %s", err)
+	}
+	if e := next(); e.Version != "1.1.0-beta.1" || e.Type != pushr.EventLatest {
+		t.Errorf("Wrong latest version after promotion %v", e)
+	}
+
+	// The stream is reconnected, the unchanged latest version is not sent again
+	ts.CloseClientConnections()
+	http.DefaultClient.CloseIdleConnections()
+	if resp := upload(t, ts.URL+"/releases/test/2.0.0/test.zip", strings.NewReader("TESTOUTPUT")); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Upload failed with status %d", resp.StatusCode)
+	}
+	if err := c.Promote("test", "stable", "2.0.0"); err != nil {
+		t.Fatalf("Promote failed: %s", err)
+	}
+	if e := next(); e.Version != "2.0.0" {
+		t.Errorf("Wrong latest version after reconnect %v", e)
+	}
+
+	cancel()
+	for range events {
+	}
+}
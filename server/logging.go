@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+// newLogger returns a structured logger writing to w in the given format, json or logfmt.
+func newLogger(w io.Writer, format string) (*slog.Logger, error) {
+	switch format {
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, nil)), nil
+	case "logfmt":
+		return slog.New(slog.NewTextHandler(w, nil)), nil
+	}
+	return nil, fmt.Errorf("Unknown log format %q", format)
+}
+
+// openLog opens the log file at path for appending, - is stdout.
+func openLog(path string) (io.Writer, error) {
+	if path == "-" {
+		return os.Stdout, nil
+	}
+	return os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+}
+
+// identified records the identity the request was authorized as, for the access and audit log.
+func identified(w http.ResponseWriter, identity string) {
+	if mw, ok := w.(*metricsWriter); ok {
+		mw.identity = identity
+	}
+}
+
+// requestIdentity returns the identity the request was authorized as.
+func requestIdentity(w http.ResponseWriter) string {
+	if mw, ok := w.(*metricsWriter); ok {
+		return mw.identity
+	}
+	return ""
+}
+
+// remoteAddr returns the IP address of the client.
+func remoteAddr(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// logRequest writes the access log entry of a request.
+// Only the path is logged, the query may contain a token or a link signature.
+func (a *RestAPI) logRequest(r *http.Request, mw *metricsWriter, received int64, d time.Duration) {
+	if a.accessLog == nil {
+		return
+	}
+	a.accessLog.LogAttrs(r.Context(), slog.LevelInfo, "request",
+		slog.String("method", r.Method),
+		slog.String("path", r.URL.Path),
+		slog.String("route", mw.route),
+		slog.String("release", mw.vars["name"]),
+		slog.String("version", mw.vars["version"]),
+		slog.Int("status", mw.code),
+		slog.Int64("bytes_sent", mw.bytes),
+		slog.Int64("bytes_received", received),
+		slog.Float64("duration_ms", float64(d.Microseconds())/1000),
+		slog.String("identity", mw.identity),
+		slog.String("remote", remoteAddr(r)),
+		slog.String("user_agent", r.UserAgent()),
+	)
+}
+
+// audit writes an entry of a successful mutating action to the audit log.
+func (a *RestAPI) audit(w http.ResponseWriter, r *http.Request, action string, attrs ...slog.Attr) {
+	if a.auditLog == nil {
+		return
+	}
+	attrs = append([]slog.Attr{
+		slog.String("action", action),
+		slog.String("identity", requestIdentity(w)),
+		slog.String("remote", remoteAddr(r)),
+	}, attrs...)
+	a.auditLog.LogAttrs(r.Context(), slog.LevelInfo, "audit", attrs...)
+}
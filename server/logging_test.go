@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/blang/pushr"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// syncBuffer is a buffer safe for concurrent use, requests are logged after the response was sent.
+type syncBuffer struct {
+	sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.Lock()
+	defer b.Unlock()
+	return b.buf.String()
+}
+
+func TestAccessAndAuditLog(t *testing.T) {
+	a, ts, cleanup := newTestServer(t)
+	defer cleanup()
+	var accessLog, auditLog syncBuffer
+	a.accessLog, _ = newLogger(&accessLog, "json")
+	a.auditLog, _ = newLogger(&auditLog, "json")
+	a.tokens.writeToken = "WRITE-SECRET"
+
+	admin := pushr.NewClient(ts.URL, "WRITE-SECRET", "WRITE-SECRET")
+	token, err := admin.CreateToken(&pushr.Token{Name: "ci", Scopes: []string{pushr.ScopeRead, pushr.ScopeWrite}})
+	if err != nil {
+		t.Fatalf("Could not create token: %s", err)
+	}
+	ci := pushr.NewClient(ts.URL, token.Secret, token.Secret)
+	if err := ci.Upload("test", "1.0.0", "test.zip", strings.NewReader("TEST")); err != nil {
+		t.Fatalf("Upload failed: %s", err)
+	}
+	if err := ci.Upload("test", "1.0.0", "test.zip", strings.NewReader("TEST")); err == nil {
+		t.Fatal("Duplicate upload succeeded")
+	}
+	if err := ci.Promote("test", "stable", "1.0.0"); err != nil {
+		t.Fatalf("Promote failed: %s", err)
+	}
+	if err := ci.Yank("test", "1.0.0"); err != nil {
+		t.Fatalf("Yank failed: %s", err)
+	}
+	// The promoted version cannot be deleted
+	if err := admin.Upload("test", "0.9.0", "test.zip", strings.NewReader("TEST")); err != nil {
+		t.Fatalf("Upload failed: %s", err)
+	}
+	if err := admin.Delete("test", "0.9.0"); err != nil {
+		t.Fatalf("Delete failed: %s", err)
+	}
+	if err := admin.RevokeToken("ci"); err != nil {
+		t.Fatalf("Revoke failed: %s", err)
+	}
+	resp, err := http.Get(ts.URL + "/releases/test?token=" + token.Secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	for i := 0; strings.Count(accessLog.String(), "\n") < 9; i++ {
+		if i > 1000 {
+			t.Fatal("Requests not logged")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	for _, secret := range []string{"WRITE-SECRET", token.Secret} {
+		if strings.Contains(accessLog.String(), secret) || strings.Contains(auditLog.String(), secret) {
+			t.Errorf("Secret %s logged", secret)
+		}
+	}
+
+	var requests []map[string]interface{}
+	dec := json.NewDecoder(strings.NewReader(accessLog.String()))
+	for dec.More() {
+		var entry map[string]interface{}
+		if err := dec.Decode(&entry); err != nil {
+			t.Fatalf("Invalid access log: %s", err)
+		}
+		requests = append(requests, entry)
+	}
+	if len(requests) != 9 {
+		t.Fatalf("Expected 9 access log entries, got %d", len(requests))
+	}
+	upload := requests[1]
+	for key, expected := range map[string]interface{}{
+		"method":         "POST",
+		"path":           "/releases/test/1.0.0/test.zip",
+		"route":          "/releases/{name}/{version}/{filename}",
+		"release":        "test",
+		"version":        "1.0.0",
+		"status":         float64(http.StatusCreated),
+		"bytes_received": float64(4),
+		"identity":       "ci",
+	} {
+		if upload[key] != expected {
+			t.Errorf("Access log %s: expected %v, got %v", key, expected, upload[key])
+		}
+	}
+	if requests[0]["identity"] != "writetoken" || requests[8]["identity"] != "unknown" || requests[8]["status"] != float64(http.StatusUnauthorized) {
+		t.Errorf("Wrong identities: %v %v", requests[0], requests[8])
+	}
+
+	var actions []string
+	dec = json.NewDecoder(strings.NewReader(auditLog.String()))
+	for dec.More() {
+		var entry map[string]interface{}
+		if err := dec.Decode(&entry); err != nil {
+			t.Fatalf("Invalid audit log: %s", err)
+		}
+		actions = append(actions, entry["action"].(string)+":"+entry["identity"].(string))
+	}
+	expected := []string{"token.create:writetoken", "upload:ci", "promote:ci", "yank:ci", "upload:writetoken", "delete:writetoken", "token.revoke:writetoken"}
+	if strings.Join(actions, ",") != strings.Join(expected, ",") {
+		t.Errorf("Wrong audit log: %v", actions)
+	}
+}
@@ -2,109 +2,178 @@ package main
 
 import (
 	"flag"
-	"github.com/blang/pushr"
-	"github.com/blang/semver"
-	"io/ioutil"
 	"log"
-	"mime"
 	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
-	"strings"
-	"sync"
 	"syscall"
+	"time"
 )
 
-type DataStore struct {
-	sync.RWMutex
-	dataDir  string
-	releases map[string]*pushr.Release
-}
-
-func (d *DataStore) Filepath(version *pushr.Version) string {
-	return filepath.Join(d.dataDir, version.Filename)
-}
-
 func main() {
 	var (
-		listen     = flag.String("listen", "127.0.0.1:7000", "REST API, e.g. 127.0.0.1:7000")
-		dataDir    = flag.String("datadir", "./data", "Data directory")
-		readToken  = flag.String("readtoken", "", "Read-only token")
-		writeToken = flag.String("writetoken", "", "Write token")
+		listen       = flag.String("listen", "127.0.0.1:7000", "REST API, e.g. 127.0.0.1:7000")
+		dataDir      = flag.String("datadir", "./data", "Data directory of the fs storage")
+		storage      = flag.String("storage", "fs", "Storage backend: fs or s3")
+		s3Endpoint   = flag.String("s3-endpoint", "", "S3 endpoint, e.g. https://s3.amazonaws.com")
+		s3Bucket     = flag.String("s3-bucket", "", "S3 bucket")
+		s3Prefix     = flag.String("s3-prefix", "", "S3 key prefix, e.g. pushr/")
+		s3Region     = flag.String("s3-region", "us-east-1", "S3 region")
+		readToken    = flag.String("readtoken", "", "Read-only token")
+		writeToken   = flag.String("writetoken", "", "Write token, granting all scopes including token administration")
+		tokenFile    = flag.String("tokenfile", "", "File of the scoped API tokens, once it exists every request needs a token (default: .tokens.json in datadir)")
+		queryTokens  = flag.Bool("querytokens", true, "Accept tokens in the token query parameter, which leaks them into URLs; signed links share downloads without token")
+		urlKeyFile   = flag.String("urlkey", "", "File of the key signing download links, generated if missing (default: .urlkey in datadir)")
+		stagingDir   = flag.String("stagingdir", "", "Directory for running uploads (default: .staging in datadir)")
+		withSHA512   = flag.Bool("sha512", false, "Compute SHA-512 checksums in addition to SHA-256 on upload")
+		uploadExpiry = flag.Duration("upload-expiry", defaultUploadExpiry, "Time after which idle resumable uploads are removed")
+		tlsCert      = flag.String("tls-cert", "", "TLS certificate file, reloaded on SIGHUP")
+		tlsKey       = flag.String("tls-key", "", "TLS key file, reloaded on SIGHUP")
+		tlsClientCA  = flag.String("tls-client-ca", "", "CA bundle verifying client certificates, which authenticate as the token named by their common name; without token file they grant read access only")
+		accessLog    = flag.String("accesslog", "-", "Access log file, - for stdout, empty to disable")
+		auditLog     = flag.String("auditlog", "", "Append-only audit log file of uploads, deletions, promotions and token changes (default: .audit.log in datadir)")
+		logFormat    = flag.String("logformat", "json", "Format of the access and audit log: json or logfmt")
+		webhookFile  = flag.String("webhooks", "", "JSON file of webhooks notified on uploads, deletions, yanks and promotions")
+		shutdownWait = flag.Duration("shutdown-timeout", defaultShutdownTimeout, "Time in-flight requests get to finish on shutdown")
 	)
 	flag.Parse()
-	log.Printf("Readtoken: %q, Writetoken: %q\n", *readToken, *writeToken)
-	ds, err := buildDataStore(*dataDir)
+	var err error
+	var st Storage
+	switch *storage {
+	case "fs":
+		st, err = newFSStorage(*dataDir)
+	case "s3":
+		// Credentials are read from the environment to keep them out of the process list
+		st, err = newS3Storage(*s3Endpoint, *s3Bucket, *s3Prefix, *s3Region, os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY"))
+	default:
+		log.Fatalf("Unknown storage %q", *storage)
+	}
 	if err != nil {
-		log.Fatalf("Could not read data dir: %s", err)
+		log.Fatalf("Could not setup storage: %s", err)
+	}
+	if *stagingDir == "" {
+		*stagingDir = filepath.Join(*dataDir, ".staging")
+	}
+	if err := cleanStagingDir(*stagingDir); err != nil {
+		log.Fatalf("Could not setup staging dir: %s", err)
+	}
+	ds, err := loadDataStore(st)
+	if err != nil {
+		log.Fatalf("Could not read data store: %s", err)
 	}
 
-	restapi := NewRestAPI(*readToken, *writeToken, ds)
-	go func() {
-		log.Printf("Start RestAPI listening on %q", *listen)
-		if err := http.ListenAndServe(*listen, restapi); err != nil {
-			log.Fatalf("HTTP Server crashed: %q", err)
-		}
-	}()
-
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt, os.Kill, syscall.SIGINT, syscall.SIGTERM)
+	if *tokenFile == "" {
+		*tokenFile = filepath.Join(*dataDir, ".tokens.json")
+	}
+	tokens, err := loadTokenStore(*tokenFile, *readToken, *writeToken)
+	if err != nil {
+		log.Fatalf("Could not read tokens: %s", err)
+	}
 
-	s := <-c
-	log.Printf("Received signal %q, shut down gracefully\n", s)
-	log.Printf("Graceful shutdown complete")
-}
+	if *urlKeyFile == "" {
+		*urlKeyFile = filepath.Join(*dataDir, ".urlkey")
+	}
+	urlKey, err := loadURLKey(*urlKeyFile)
+	if err != nil {
+		log.Fatalf("Could not load URL signing key: %s", err)
+	}
 
-func buildDataStore(dataDir string) (*DataStore, error) {
-	files, err := ioutil.ReadDir(dataDir)
+	restapi := NewRestAPI(tokens, ds)
+	restapi.urlKey = urlKey
+	restapi.queryTokens = *queryTokens
+	restapi.withSHA512 = *withSHA512
+	restapi.stagingDir = *stagingDir
+	restapi.sessions.expiry = *uploadExpiry
+	if *accessLog != "" {
+		w, err := openLog(*accessLog)
+		if err != nil {
+			log.Fatalf("Could not open access log: %s", err)
+		}
+		if restapi.accessLog, err = newLogger(w, *logFormat); err != nil {
+			log.Fatalf("Could not setup access log: %s", err)
+		}
+	}
+	if *auditLog == "" {
+		*auditLog = filepath.Join(*dataDir, ".audit.log")
+	}
+	w, err := openLog(*auditLog)
 	if err != nil {
-		return nil, err
+		log.Fatalf("Could not open audit log: %s", err)
 	}
-	ds := &DataStore{
-		dataDir:  dataDir,
-		releases: make(map[string]*pushr.Release),
+	if restapi.auditLog, err = newLogger(w, *logFormat); err != nil {
+		log.Fatalf("Could not setup audit log: %s", err)
+	}
+	if *webhookFile != "" {
+		hooks, err := loadWebhooks(*webhookFile)
+		if err != nil {
+			log.Fatalf("Could not load webhooks: %s", err)
+		}
+		restapi.webhooks = newWebhooks(hooks)
+	}
+	restapi.stats, err = loadDownloadStats(st)
+	if err != nil {
+		log.Fatalf("Could not read download statistics: %s", err)
 	}
-	for _, f := range files {
-		parts := strings.SplitN(f.Name(), "-", 2)
-		if len(parts) != 2 {
-			log.Printf("Could not parse filename %s\n", f.Name())
-			continue
+	go func() {
+		for range time.Tick(statsSaveInterval) {
+			if err := restapi.stats.save(); err != nil {
+				log.Printf("Could not save download statistics: %s", err)
+			}
 		}
-		ext := filepath.Ext(f.Name())
-		if ext == "" {
-			log.Printf("Could not find extension of file %s\n", f.Name())
-			continue
+	}()
+	go func() {
+		for now := range time.Tick(time.Minute) {
+			restapi.expireUploadSessions(now)
 		}
-		versionStr := strings.TrimSuffix(parts[1], ext)
-		_, err := semver.New(versionStr)
+	}()
+	srv := &http.Server{Addr: *listen, Handler: restapi}
+	if *tlsCert != "" || *tlsKey != "" {
+		certs, err := newCertReloader(*tlsCert, *tlsKey)
 		if err != nil {
-			log.Printf("Could not parse version of file %s\n", f.Name())
-			continue
+			log.Fatalf("Could not load TLS certificate: %s", err)
 		}
-		//TODO: Check filename for invalid chars
-
-		var r *pushr.Release
-		r, found := ds.releases[parts[0]]
-		if !found {
-			r = &pushr.Release{
-				Versions: make(map[string]*pushr.Version),
+		srv.TLSConfig, err = newTLSConfig(certs, *tlsClientCA)
+		if err != nil {
+			log.Fatalf("Could not load client CA: %s", err)
+		}
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go func() {
+			for range hup {
+				if err := certs.reload(); err != nil {
+					log.Printf("Could not reload TLS certificate, keeping the current one: %s", err)
+				} else {
+					log.Printf("Reloaded TLS certificate")
+				}
 			}
-			ds.releases[parts[0]] = r
+		}()
+	} else if *tlsClientCA != "" {
+		log.Fatalf("Client certificates need -tls-cert and -tls-key")
+	}
+	go func() {
+		log.Printf("Start RestAPI listening on %q", *listen)
+		var err error
+		if srv.TLSConfig != nil {
+			err = srv.ListenAndServeTLS("", "")
+		} else {
+			err = srv.ListenAndServe()
 		}
-
-		_, found = r.Versions[versionStr]
-		if found {
-			log.Printf("Duplicate version of file %s: %s\n", f.Name(), versionStr)
-			continue
+		if err != http.ErrServerClosed {
+			log.Fatalf("HTTP Server crashed: %q", err)
 		}
-		v := &pushr.Version{}
-		v.Size = f.Size()
-		v.ContentType = mime.TypeByExtension(ext)
-		v.Filename = f.Name()
-		r.Versions[versionStr] = v
-		log.Printf("Read %s: Release %q, Version: %q, Content-Type: %q, Size: %dB", f.Name(), parts[0], versionStr, v.ContentType, v.Size)
-	}
+	}()
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 
-	return ds, nil
+	s := <-c
+	log.Printf("Received signal %q, shut down gracefully\n", s)
+	// A second signal terminates immediately
+	signal.Stop(c)
+	if err := shutdown(srv, restapi, *shutdownWait); err != nil {
+		log.Printf("Shutdown incomplete: %s", err)
+		os.Exit(1)
+	}
+	log.Printf("Graceful shutdown complete")
 }
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"fmt"
+	"github.com/gorilla/mux"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Upper bounds of the request duration histogram in seconds, uploads and downloads of large files take minutes
+var durationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 300}
+
+type requestKey struct {
+	route  string
+	method string
+	code   int
+}
+
+type routeKey struct {
+	route  string
+	method string
+}
+
+type downloadKey struct {
+	release string
+	version string
+}
+
+// histogram counts observations in cumulative buckets, as exposed by Prometheus.
+type histogram struct {
+	counts []uint64 // Per bucket of durationBuckets, not cumulative
+	count  uint64
+	sum    float64
+}
+
+func (h *histogram) observe(v float64) {
+	for i, bound := range durationBuckets {
+		if v <= bound {
+			h.counts[i]++
+			break
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+// metrics collects the counters exposed by /metrics in the Prometheus text format.
+type metrics struct {
+	sync.Mutex
+	requests  map[requestKey]uint64
+	durations map[routeKey]*histogram
+	downloads map[downloadKey]uint64
+
+	bytesSent     uint64 // Accessed atomically
+	bytesReceived uint64 // Accessed atomically
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		requests:  make(map[requestKey]uint64),
+		durations: make(map[routeKey]*histogram),
+		downloads: make(map[downloadKey]uint64),
+	}
+}
+
+func (m *metrics) observeRequest(route string, method string, code int, d time.Duration) {
+	m.Lock()
+	defer m.Unlock()
+	m.requests[requestKey{route, method, code}]++
+	h, found := m.durations[routeKey{route, method}]
+	if !found {
+		h = &histogram{counts: make([]uint64, len(durationBuckets))}
+		m.durations[routeKey{route, method}] = h
+	}
+	h.observe(d.Seconds())
+}
+
+func (m *metrics) observeDownload(release string, version string) {
+	m.Lock()
+	defer m.Unlock()
+	m.downloads[downloadKey{release, version}]++
+}
+
+// metricsWriter records the status code and the size of a response, the route which served it
+// and the identity of the client, for the metrics and the access log.
+type metricsWriter struct {
+	http.ResponseWriter
+	metrics  *metrics
+	code     int
+	bytes    int64
+	route    string
+	vars     map[string]string // Route variables, kept as they are cleared once the router returns
+	identity string
+}
+
+func (w *metricsWriter) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *metricsWriter) Write(p []byte) (int, error) {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.bytes += int64(n)
+	atomic.AddUint64(&w.metrics.bytesSent, uint64(n))
+	return n, err
+}
+
+func (w *metricsWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// metricsBody counts the bytes read from a request body.
+type metricsBody struct {
+	io.ReadCloser
+	metrics *metrics
+	bytes   int64
+}
+
+func (b *metricsBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.bytes += int64(n)
+	atomic.AddUint64(&b.metrics.bytesReceived, uint64(n))
+	return n, err
+}
+
+// handle registers handler for path, labeling its requests with path as route in the metrics.
+func (a *RestAPI) handle(path string, handler http.Handler) {
+	a.router.Handle(path, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if mw, ok := w.(*metricsWriter); ok {
+			mw.route = path
+			mw.vars = mux.Vars(r)
+		}
+		handler.ServeHTTP(w, r)
+	}))
+}
+
+// instrument serves the request with handler and records it in the metrics and the access log.
+func (a *RestAPI) instrument(w http.ResponseWriter, r *http.Request, handler http.Handler) {
+	start := time.Now()
+	mw := &metricsWriter{ResponseWriter: w, metrics: a.metrics}
+	body := &metricsBody{ReadCloser: r.Body, metrics: a.metrics}
+	if r.Body != nil {
+		r.Body = body
+	}
+	handler.ServeHTTP(mw, r)
+	if mw.code == 0 {
+		mw.code = http.StatusOK
+	}
+	route := mw.route
+	if route == "" {
+		// Keep the number of series bounded, unknown paths are not labeled individually
+		route = "unmatched"
+	}
+	a.metrics.observeRequest(route, r.Method, mw.code, time.Since(start))
+	a.logRequest(r, mw, body.bytes, time.Since(start))
+}
+
+func (a *RestAPI) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	a.metrics.writeTo(w)
+
+	a.uploads.Lock()
+	inFlight := a.uploads.inFlight
+	a.uploads.Unlock()
+	a.sessions.Lock()
+	sessions := len(a.sessions.sessions)
+	a.sessions.Unlock()
+	files, size := a.ds.usage()
+
+	writeMetric(w, "pushr_uploads_in_flight", "gauge", "Uploads currently being received.")
+	fmt.Fprintf(w, "pushr_uploads_in_flight %d\n", inFlight)
+	writeMetric(w, "pushr_upload_sessions", "gauge", "Open resumable upload sessions.")
+	fmt.Fprintf(w, "pushr_upload_sessions %d\n", sessions)
+	writeMetric(w, "pushr_storage_files", "gauge", "Number of stored release files.")
+	fmt.Fprintf(w, "pushr_storage_files %d\n", files)
+	writeMetric(w, "pushr_storage_bytes", "gauge", "Total size of stored release files.")
+	fmt.Fprintf(w, "pushr_storage_bytes %d\n", size)
+}
+
+// writeTo writes the request metrics in the Prometheus text format, sorted for stable output.
+func (m *metrics) writeTo(w io.Writer) {
+	m.Lock()
+	defer m.Unlock()
+
+	writeMetric(w, "pushr_http_requests_total", "counter", "HTTP requests by route, method and status code.")
+	requests := make([]requestKey, 0, len(m.requests))
+	for k := range m.requests {
+		requests = append(requests, k)
+	}
+	sort.Slice(requests, func(i, j int) bool {
+		a, b := requests[i], requests[j]
+		if a.route != b.route {
+			return a.route < b.route
+		}
+		if a.method != b.method {
+			return a.method < b.method
+		}
+		return a.code < b.code
+	})
+	for _, k := range requests {
+		fmt.Fprintf(w, "pushr_http_requests_total{route=%s,method=%s,code=\"%d\"} %d\n", labelValue(k.route), labelValue(k.method), k.code, m.requests[k])
+	}
+
+	writeMetric(w, "pushr_http_request_duration_seconds", "histogram", "HTTP request latencies by route and method.")
+	routes := make([]routeKey, 0, len(m.durations))
+	for k := range m.durations {
+		routes = append(routes, k)
+	}
+	sort.Slice(routes, func(i, j int) bool {
+		if routes[i].route != routes[j].route {
+			return routes[i].route < routes[j].route
+		}
+		return routes[i].method < routes[j].method
+	})
+	for _, k := range routes {
+		h := m.durations[k]
+		labels := "route=" + labelValue(k.route) + ",method=" + labelValue(k.method)
+		var cumulative uint64
+		for i, bound := range durationBuckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(w, "pushr_http_request_duration_seconds_bucket{%s,le=\"%s\"} %d\n", labels, strconv.FormatFloat(bound, 'g', -1, 64), cumulative)
+		}
+		fmt.Fprintf(w, "pushr_http_request_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", labels, h.count)
+		fmt.Fprintf(w, "pushr_http_request_duration_seconds_sum{%s} %s\n", labels, strconv.FormatFloat(h.sum, 'g', -1, 64))
+		fmt.Fprintf(w, "pushr_http_request_duration_seconds_count{%s} %d\n", labels, h.count)
+	}
+
+	writeMetric(w, "pushr_http_response_bytes_total", "counter", "Bytes sent in response bodies.")
+	fmt.Fprintf(w, "pushr_http_response_bytes_total %d\n", atomic.LoadUint64(&m.bytesSent))
+	writeMetric(w, "pushr_http_request_bytes_total", "counter", "Bytes received in request bodies.")
+	fmt.Fprintf(w, "pushr_http_request_bytes_total %d\n", atomic.LoadUint64(&m.bytesReceived))
+
+	writeMetric(w, "pushr_downloads_total", "counter", "Downloads by release and version, resumed downloads are counted once.")
+	downloads := make([]downloadKey, 0, len(m.downloads))
+	for k := range m.downloads {
+		downloads = append(downloads, k)
+	}
+	sort.Slice(downloads, func(i, j int) bool {
+		if downloads[i].release != downloads[j].release {
+			return downloads[i].release < downloads[j].release
+		}
+		return downloads[i].version < downloads[j].version
+	})
+	for _, k := range downloads {
+		fmt.Fprintf(w, "pushr_downloads_total{release=%s,version=%s} %d\n", labelValue(k.release), labelValue(k.version), m.downloads[k])
+	}
+}
+
+func writeMetric(w io.Writer, name string, typ string, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labelValue quotes a label value for the Prometheus text format.
+func labelValue(s string) string {
+	return `"` + labelEscaper.Replace(s) + `"`
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"github.com/blang/pushr"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHistogram(t *testing.T) {
+	m := newMetrics()
+	m.observeRequest("/ping", "GET", 200, 3*time.Millisecond)
+	m.observeRequest("/ping", "GET", 200, 70*time.Millisecond)
+	m.observeRequest("/ping", "GET", 500, time.Hour)
+	var buf bytes.Buffer
+	m.writeTo(&buf)
+	out := buf.String()
+	for _, line := range []string{
+		`pushr_http_requests_total{route="/ping",method="GET",code="200"} 2`,
+		`pushr_http_requests_total{route="/ping",method="GET",code="500"} 1`,
+		`pushr_http_request_duration_seconds_bucket{route="/ping",method="GET",le="0.005"} 1`,
+		`pushr_http_request_duration_seconds_bucket{route="/ping",method="GET",le="0.05"} 1`,
+		`pushr_http_request_duration_seconds_bucket{route="/ping",method="GET",le="0.1"} 2`,
+		`pushr_http_request_duration_seconds_bucket{route="/ping",method="GET",le="300"} 2`,
+		`pushr_http_request_duration_seconds_bucket{route="/ping",method="GET",le="+Inf"} 3`,
+		`pushr_http_request_duration_seconds_sum{route="/ping",method="GET"} 3600.073`,
+		`pushr_http_request_duration_seconds_count{route="/ping",method="GET"} 3`,
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("Missing %s in:\n%s", line, out)
+		}
+	}
+	if labelValue("a\"b\\c\nd") != `"a\"b\\c\nd"` {
+		t.Errorf("Wrong escaping: %s", labelValue("a\"b\\c\nd"))
+	}
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	a, ts, cleanup := newTestServer(t)
+	defer cleanup()
+
+	if resp := upload(t, ts.URL+"/releases/test/1.0.0/test.zip", strings.NewReader("TESTOUTPUT")); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Upload failed with status %d", resp.StatusCode)
+	}
+	for i := 0; i < 2; i++ {
+		resp, err := http.Get(ts.URL + "/releases/test/1.0.0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+	// Resumed downloads and metadata requests are no downloads
+	req, _ := http.NewRequest("GET", ts.URL+"/releases/test/1.0.0", nil)
+	req.Header.Set("Range", "bytes=4-")
+	if resp, err := http.DefaultClient.Do(req); err == nil {
+		resp.Body.Close()
+	}
+	req, _ = http.NewRequest("GET", ts.URL+"/releases/test/1.0.0", nil)
+	req.Header.Set("Accept", "application/json")
+	if resp, err := http.DefaultClient.Do(req); err == nil {
+		resp.Body.Close()
+	}
+	if resp, err := http.Get(ts.URL + "/releases/test/2.0.0"); err == nil {
+		resp.Body.Close()
+	}
+	if resp, err := http.Get(ts.URL + "/unknown/path"); err == nil {
+		resp.Body.Close()
+	}
+
+	resp, err := http.Get(ts.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain") {
+		t.Errorf("Wrong content type %s", resp.Header.Get("Content-Type"))
+	}
+	out := string(b)
+	for _, line := range []string{
+		`pushr_http_requests_total{route="/releases/{name}/{version}/{filename}",method="POST",code="201"} 1`,
+		`pushr_http_requests_total{route="/releases/{name}/{version}",method="GET",code="200"} 3`,
+		`pushr_http_requests_total{route="/releases/{name}/{version}",method="GET",code="206"} 1`,
+		`pushr_http_requests_total{route="/releases/{name}/{version}",method="GET",code="404"} 1`,
+		`pushr_http_requests_total{route="unmatched",method="GET",code="404"} 1`,
+		`pushr_http_request_bytes_total 10`,
+		`pushr_downloads_total{release="test",version="1.0.0"} 2`,
+		`pushr_uploads_in_flight 0`,
+		`pushr_storage_files 1`,
+		`pushr_storage_bytes 10`,
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("Missing %s in:\n%s", line, out)
+		}
+	}
+	// Response bytes include the downloads and the range
+	if !strings.Contains(out, "pushr_http_response_bytes_total ") || strings.Contains(out, "pushr_http_response_bytes_total 0\n") {
+		t.Errorf("No bytes sent counted:\n%s", out)
+	}
+
+	// Metrics contain all releases, tokens limited to some releases are denied
+	token, err := a.tokens.create(&pushr.Token{Name: "team", Scopes: []string{pushr.ScopeRead}, Releases: []string{"test"}})
+	if err != nil {
+		t.Fatalf("Could not create token: %s", err)
+	}
+	for path, expected := range map[string]int{"/metrics": http.StatusForbidden, "/releases/test/stats": http.StatusOK} {
+		req, _ := http.NewRequest("GET", ts.URL+path, nil)
+		req.Header.Set("X-PUSHR-TOKEN", token.Secret)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != expected {
+			t.Errorf("%s with release-scoped token: expected %d, got %d", path, expected, resp.StatusCode)
+		}
+	}
+}
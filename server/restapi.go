@@ -1,6 +1,8 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"github.com/blang/methodr"
@@ -8,26 +10,46 @@ import (
 	"github.com/blang/semver"
 	"github.com/gorilla/mux"
 	"io"
-	"mime"
+	"log/slog"
 	"net/http"
-	"os"
+	"net/url"
+	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 )
 
 type RestAPI struct {
-	router     *mux.Router
-	readToken  string
-	writeToken string
-	ds         *DataStore
+	router      *mux.Router
+	tokens      *tokenStore
+	ds          *DataStore
+	withSHA512  bool   // Compute SHA-512 checksums in addition to SHA-256 on upload
+	stagingDir  string // Directory for running uploads, the system temp dir if empty
+	sessions    *uploadSessions
+	urlKey      []byte       // Key signing download links
+	queryTokens bool         // Accept tokens in the token query parameter in addition to the header
+	accessLog   *slog.Logger // Disabled if nil
+	auditLog    *slog.Logger // Disabled if nil
+	uploads     uploadTracker
+	metrics     *metrics
+	stats       *downloadStats
+	webhooks    *webhooks
+	events      *eventBroker
 }
 
-func NewRestAPI(readToken string, writeToken string, ds *DataStore) *RestAPI {
+func NewRestAPI(tokens *tokenStore, ds *DataStore) *RestAPI {
 	r := &RestAPI{
-		router:     mux.NewRouter(),
-		readToken:  readToken,
-		writeToken: writeToken,
-		ds:         ds,
+		router:      mux.NewRouter(),
+		tokens:      tokens,
+		ds:          ds,
+		sessions:    newUploadSessions(),
+		urlKey:      newURLKey(), // Links do not survive restarts unless a persistent key is set
+		queryTokens: true,
+		metrics:     newMetrics(),
+		stats:       newDownloadStats(nil),
+		webhooks:    newWebhooks(nil),
+		events:      newEventBroker(),
 	}
 	r.registerEndpoints()
 	return r
@@ -36,22 +58,58 @@ func NewRestAPI(readToken string, writeToken string, ds *DataStore) *RestAPI {
 func (a *RestAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Methods", "GET,POST,PUT,PATCH,OPTIONS")
-	w.Header().Set("Access-Control-Allow-Headers", "Origin,Authorization,Content-Type")
+	w.Header().Set("Access-Control-Allow-Methods", "GET,POST,PUT,PATCH,DELETE,OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Origin,Authorization,Content-Type,Upload-Offset,"+pushr.SignatureHeader)
+	w.Header().Set("Access-Control-Expose-Headers", "Location,Upload-Offset,"+pushr.SignatureHeader)
 	w.Header().Set("Access-Control-Allow-Credentials", "true")
 
 	if r.Method == "OPTIONS" {
 		w.WriteHeader(http.StatusOK)
 	} else {
-		a.router.ServeHTTP(w, r)
+		a.instrument(w, r, a.router)
 	}
 }
 
 func (a *RestAPI) registerEndpoints() {
-	a.router.Handle("/ping", http.HandlerFunc(a.handlePing))
-	a.router.Handle("/releases/{name}", methodr.GET(a.readAccess(http.HandlerFunc(a.handleReleaseList))))
-	a.router.Handle("/releases/{name}/{version}", methodr.GET(a.readAccess(http.HandlerFunc(a.handleGetRelease))))
-	a.router.Handle("/releases/{name}/{version}/{filename}", methodr.POST(a.writeAccess(http.HandlerFunc(a.handlePostRelease))))
+	a.handle("/ping", http.HandlerFunc(a.handlePing))
+	a.handle("/metrics", methodr.GET(a.accessAll(pushr.ScopeRead, http.HandlerFunc(a.handleMetrics))))
+	a.handle("/tokens", &methodr.Mux{
+		Get:  a.accessAll(pushr.ScopeAdmin, http.HandlerFunc(a.handleListTokens)),
+		Post: a.accessAll(pushr.ScopeAdmin, http.HandlerFunc(a.handleCreateToken)),
+	})
+	a.handle("/tokens/{token}", methodr.DELETE(a.accessAll(pushr.ScopeAdmin, http.HandlerFunc(a.handleRevokeToken))))
+	a.handle("/webhooks/deliveries", methodr.GET(a.accessAll(pushr.ScopeAdmin, http.HandlerFunc(a.handleWebhookDeliveries))))
+	a.handle("/uploads", methodr.POST(a.uploading(a.access(pushr.ScopeWrite, http.HandlerFunc(a.handleCreateUpload)))))
+	a.handle("/uploads/{id}", &methodr.Mux{
+		Get:    a.access(pushr.ScopeWrite, http.HandlerFunc(a.handleGetUpload)),
+		Head:   a.access(pushr.ScopeWrite, http.HandlerFunc(a.handleGetUpload)),
+		Patch:  a.uploading(a.access(pushr.ScopeWrite, http.HandlerFunc(a.handlePatchUpload))),
+		Delete: a.access(pushr.ScopeWrite, http.HandlerFunc(a.handleAbortUpload)),
+	})
+	a.handle("/uploads/{id}/complete", methodr.POST(a.uploading(a.access(pushr.ScopeWrite, http.HandlerFunc(a.handleCompleteUpload)))))
+	a.handle("/releases/{name}", methodr.GET(a.access(pushr.ScopeRead, http.HandlerFunc(a.handleReleaseList))))
+	a.handle("/releases/{name}/latest", methodr.GET(a.access(pushr.ScopeRead, http.HandlerFunc(a.handleLatest))))
+	a.handle("/releases/{name}/latest/download", methodr.GET(a.access(pushr.ScopeRead, http.HandlerFunc(a.handleLatestDownload))))
+	a.handle("/releases/{name}/events", methodr.GET(a.access(pushr.ScopeRead, http.HandlerFunc(a.handleReleaseEvents))))
+	a.handle("/releases/{name}/stats", methodr.GET(a.access(pushr.ScopeRead, http.HandlerFunc(a.handleReleaseStats))))
+	a.handle("/releases/{name}/channels/{channel}", &methodr.Mux{
+		Get:    a.access(pushr.ScopeRead, http.HandlerFunc(a.handleGetChannel)),
+		Post:   a.access(pushr.ScopeWrite, http.HandlerFunc(a.handlePromote)),
+		Delete: a.access(pushr.ScopeWrite, http.HandlerFunc(a.handleUnpromote)),
+	})
+	a.handle("/releases/{name}/{version}", &methodr.Mux{
+		Get:    a.signedAccess(http.HandlerFunc(a.handleGetRelease)),
+		Delete: a.access(pushr.ScopeDelete, http.HandlerFunc(a.handleDeleteRelease)),
+	})
+	a.handle("/releases/{name}/{version}/yank", &methodr.Mux{
+		Post:   a.access(pushr.ScopeWrite, http.HandlerFunc(a.handleYank)),
+		Delete: a.access(pushr.ScopeWrite, http.HandlerFunc(a.handleYank)),
+	})
+	a.handle("/releases/{name}/{version}/stats", methodr.GET(a.access(pushr.ScopeRead, http.HandlerFunc(a.handleVersionStats))))
+	a.handle("/releases/{name}/{version}/link", methodr.POST(a.access(pushr.ScopeRead, http.HandlerFunc(a.handleCreateLink))))
+	a.handle("/releases/{name}/{version}/{filename}", methodr.POST(a.uploading(a.access(pushr.ScopeWrite, http.HandlerFunc(a.handlePostRelease)))))
+	a.handle("/releases/{name}/{version}/{os}/{arch}", methodr.GET(a.signedAccess(http.HandlerFunc(a.handleGetArtifact))))
+	a.handle("/releases/{name}/{version}/{os}/{arch}/{filename}", methodr.POST(a.uploading(a.access(pushr.ScopeWrite, http.HandlerFunc(a.handlePostArtifact)))))
 }
 
 func (a *RestAPI) handlePing(w http.ResponseWriter, r *http.Request) {
@@ -59,6 +117,8 @@ func (a *RestAPI) handlePing(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte("OK"))
 }
 
+// handleReleaseList lists the versions of a release. If the If-None-Match header matches the listing and
+// the wait query parameter is given, the response is delayed until the listing changes or the duration elapsed.
 func (a *RestAPI) handleReleaseList(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	name, found := vars["name"]
@@ -66,16 +126,167 @@ func (a *RestAPI) handleReleaseList(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
+	var wait time.Duration
+	if s := r.URL.Query().Get("wait"); s != "" {
+		var err error
+		if wait, err = time.ParseDuration(s); err != nil || wait < 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "Error: Invalid wait duration %q", s)
+			return
+		}
+		if wait > maxListingWait {
+			wait = maxListingWait
+		}
+	}
+
+	// Yanked versions are only listed on request
+	withYanked := r.URL.Query().Get("yanked") == "true"
+	var events chan *pushr.Event
+	if wait > 0 {
+		// Subscribe before reading the listing, changes in between must not be missed
+		events, _ = a.events.subscribe(name, "")
+		defer a.events.unsubscribe(name, events)
+	}
+	b, found := a.releaseListing(name, withYanked)
+	if !found {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	etag := listingETag(b)
+	if wait > 0 && r.Header.Get("If-None-Match") == etag {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+	waiting:
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-timer.C:
+				break waiting
+			case _, ok := <-events:
+				if b, found = a.releaseListing(name, withYanked); !found {
+					w.WriteHeader(http.StatusNotFound)
+					return
+				}
+				etag = listingETag(b)
+				if !ok || r.Header.Get("If-None-Match") != etag {
+					break waiting
+				}
+			}
+		}
+	}
+
+	w.Header().Set("ETag", etag)
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Write(b)
+}
+
+// releaseListing encodes the versions and channels of a release.
+func (a *RestAPI) releaseListing(name string, withYanked bool) ([]byte, bool) {
+	a.ds.RLock()
+	defer a.ds.RUnlock()
+	release, found := a.ds.releases[name]
+	if !found {
+		return nil, false
+	}
+	listed := pushr.NewRelease()
+	listed.Channels = release.Channels
+	for versionStr, version := range release.Versions {
+		if !version.Yanked || withYanked {
+			listed.Versions[versionStr] = version
+		}
+	}
+	b, _ := json.Marshal(listed)
+	return b, true
+}
+
+// listingETag returns the entity tag of an encoded release listing.
+func listingETag(b []byte) string {
+	sum := sha256.Sum256(b)
+	return "\"" + hex.EncodeToString(sum[:16]) + "\""
+}
+
+// latest resolves the latest version of the release in the channel given by the channel query parameter.
+func (a *RestAPI) latest(w http.ResponseWriter, r *http.Request) (string, string, *pushr.Version, bool) {
+	vars := mux.Vars(r)
+	name, found := vars["name"]
+	if !found {
+		w.WriteHeader(http.StatusNotFound)
+		return "", "", nil, false
+	}
 
 	a.ds.RLock()
 	defer a.ds.RUnlock()
 	release, found := a.ds.releases[name]
 	if !found {
+		// The message tells clients the endpoint exists, older servers answer without one
 		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, "Error: Release not found")
+		return "", "", nil, false
+	}
+	version, versionStr, err := release.Latest(r.URL.Query().Get("channel"))
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "Error: %s", err)
+		return "", "", nil, false
+	}
+	return name, versionStr, copyVersion(version), true
+}
+
+func (a *RestAPI) handleLatest(w http.ResponseWriter, r *http.Request) {
+	_, versionStr, version, ok := a.latest(w, r)
+	if !ok {
 		return
 	}
+	if strings.Contains(r.Header.Get("Accept"), "text/plain") {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprintln(w, versionStr)
+		return
+	}
+	json.NewEncoder(w).Encode(&pushr.ResolvedVersion{Number: versionStr, Version: version})
+}
 
-	json.NewEncoder(w).Encode(release)
+// handleLatestDownload redirects to the download of the latest version, or of its platform artifact given by the
+// os, arch and variant parameters, keeping the query string except the token.
+// The redirect marks the download with the channel it was resolved from for the download statistics.
+func (a *RestAPI) handleLatestDownload(w http.ResponseWriter, r *http.Request) {
+	name, versionStr, version, ok := a.latest(w, r)
+	if !ok {
+		return
+	}
+	query := r.URL.Query()
+	path := "/releases/" + name + "/" + versionStr
+	target := "/releases/" + url.PathEscape(name) + "/" + url.PathEscape(versionStr)
+	if goos := query.Get("os"); goos != "" {
+		platform := pushr.Platform{OS: goos, Arch: query.Get("arch"), Variant: query.Get("variant")}
+		if _, found := version.Artifacts[platform.Key()]; !found {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(w, "Error: No artifact for %s in %s", platform.Key(), versionStr)
+			return
+		}
+		path += "/" + platform.OS + "/" + platform.Arch
+		target += "/" + url.PathEscape(platform.OS) + "/" + url.PathEscape(platform.Arch)
+		query.Del("os")
+		query.Del("arch")
+	}
+	query.Del("channelsig")
+	if channel := query.Get("channel"); a.knownChannel(name, versionStr, channel) {
+		query.Set("channelsig", a.signChannel(name, versionStr, channel))
+	}
+	// The token must not end up in the Location header, a short-lived signed link grants the download instead
+	if query.Get("token") != "" && a.requestToken(r) == query.Get("token") && query.Get("signature") == "" {
+		expires := time.Now().Add(redirectLinkExpiry).Unix()
+		query.Set("expires", strconv.FormatInt(expires, 10))
+		query.Set("signature", a.signURL(path, query.Get("variant"), expires))
+	}
+	query.Del("token")
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+	http.Redirect(w, r, target, http.StatusFound)
 }
 
 func (a *RestAPI) handleGetRelease(w http.ResponseWriter, r *http.Request) {
@@ -91,128 +302,560 @@ func (a *RestAPI) handleGetRelease(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	a.ds.RLock()
-	defer a.ds.RUnlock()
+	// Work on a copy, the lock must not be held while streaming to the client
+	version, found := a.ds.Version(name, versionStr)
+	if !found {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
 
-	release, found := a.ds.releases[name]
+	if strings.Contains(r.Header.Get("Accept"), "application/json") {
+		json.NewEncoder(w).Encode(version)
+	} else if version.Filename == "" {
+		// Version consisting of platform artifacts only
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, "Error: Version has no platform independent file")
+	} else {
+		a.serveFile(w, r, &servedFile{
+			release:     name,
+			version:     versionStr,
+			filename:    version.Filename,
+			contentType: version.ContentType,
+			sha256:      version.SHA256,
+			sha512:      version.SHA512,
+			signature:   version.Signature,
+			modTime:     version.Uploaded,
+		})
+	}
+}
+
+func (a *RestAPI) handleGetArtifact(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	name, found := vars["name"]
 	if !found {
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
+	versionStr, found := vars["version"]
+	if !found {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	platform := pushr.Platform{OS: vars["os"], Arch: vars["arch"], Variant: r.URL.Query().Get("variant")}
 
-	version, found := release.Versions[versionStr]
+	version, found := a.ds.Version(name, versionStr)
+	if !found {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	artifact, found := version.Artifacts[platform.Key()]
 	if !found {
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
 
 	if strings.Contains(r.Header.Get("Accept"), "application/json") {
-		json.NewEncoder(w).Encode(version)
+		json.NewEncoder(w).Encode(artifact)
 	} else {
-		filename := a.ds.Filepath(version)
-		w.Header().Set("Content-Type", version.ContentType)
-		w.Header().Set("Content-Disposition", "attachment; filename=\""+version.Filename+"\"")
-		http.ServeFile(w, r, filename)
+		a.serveFile(w, r, &servedFile{
+			release:     name,
+			version:     versionStr,
+			filename:    artifact.Filename,
+			contentType: artifact.ContentType,
+			sha256:      artifact.SHA256,
+			sha512:      artifact.SHA512,
+			signature:   artifact.Signature,
+			modTime:     artifact.Uploaded,
+		})
 	}
 }
 
-func (a *RestAPI) handlePostRelease(w http.ResponseWriter, r *http.Request) {
+// servedFile describes a stored file for serveFile
+type servedFile struct {
+	release     string
+	version     string
+	filename    string
+	contentType string
+	sha256      string
+	sha512      string
+	signature   string
+	modTime     time.Time
+}
+
+// serveFile streams a stored file to the client, supporting range requests.
+func (a *RestAPI) serveFile(w http.ResponseWriter, r *http.Request, file *servedFile) {
+	f, err := a.ds.storage.Get(file.filename)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "Error: %s", err)
+		return
+	}
+	defer f.Close()
+	if file.sha256 != "" {
+		w.Header().Set("ETag", "\""+file.sha256+"\"")
+	}
+	if digest := pushr.DigestHeader(file.sha256, file.sha512); digest != "" {
+		w.Header().Set("Digest", digest)
+	}
+	if file.signature != "" {
+		w.Header().Set(pushr.SignatureHeader, file.signature)
+	}
+	w.Header().Set("Content-Type", file.contentType)
+	w.Header().Set("Content-Disposition", "attachment; filename=\""+path.Base(file.filename)+"\"")
+	http.ServeContent(w, r, path.Base(file.filename), file.modTime, f)
+	// Cache validations are no downloads, resumed ranges are counted as partial downloads
+	if mw, ok := w.(*metricsWriter); ok && r.Method == "GET" {
+		switch mw.code {
+		case http.StatusOK:
+			a.metrics.observeDownload(file.release, file.version)
+			a.stats.record(file.release, file.version, a.downloadChannel(r, file.release, file.version), false, time.Now())
+		case http.StatusPartialContent:
+			a.stats.record(file.release, file.version, "", true, time.Now())
+		}
+	}
+}
+
+// uploadVars validates the name, version and filename of an upload request.
+func uploadVars(w http.ResponseWriter, r *http.Request) (name string, versionStr string, fileext string, ok bool) {
 	vars := mux.Vars(r)
 	name, found := vars["name"]
 	if !found {
 		w.WriteHeader(http.StatusNotFound)
-		return
+		return "", "", "", false
 	}
-	versionStr, found := vars["version"]
+	versionStr, found = vars["version"]
 	if !found {
 		w.WriteHeader(http.StatusNotFound)
-		return
+		return "", "", "", false
 	}
 	_, err := semver.New(versionStr)
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		fmt.Fprintf(w, "Error processing version: %s", err)
-		return
+		return "", "", "", false
 	}
 
 	filename, found := vars["filename"]
 	if !found {
 		w.WriteHeader(http.StatusNotFound)
-		return
+		return "", "", "", false
 	}
 
-	a.ds.Lock()
-	defer a.ds.Unlock()
+	fileext = filepath.Ext(filename)
+	if fileext == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Error: No File extension on %q found", filename)
+		return "", "", "", false
+	}
+	return name, versionStr, fileext, true
+}
 
-	release, found := a.ds.releases[name]
-	if !found {
-		release = pushr.NewRelease()
-		a.ds.releases[name] = release
+// stage writes the request body to the staging directory and verifies it.
+// Only verified uploads are moved into the storage. The caller must remove the staged upload.
+func (a *RestAPI) stage(w http.ResponseWriter, r *http.Request) (*stagedUpload, bool) {
+	signature := r.Header.Get(pushr.SignatureHeader)
+	if !validSignature(signature) {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "Error: Invalid signature")
+		return nil, false
 	}
+	u, err := newStagedUpload(a.stagingDir, a.withSHA512)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "Error: %s", err)
+		return nil, false
+	}
+	u.signature = signature
+	defer r.Body.Close()
+	written, err := io.Copy(u, r.Body)
+	if err != nil || written == 0 {
+		u.remove()
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Error: Written %d, %s", written, err)
+		return nil, false
+	}
+	if err := u.finish(r.ContentLength, r.Header.Get("Digest")); err != nil {
+		u.remove()
+		if _, ok := err.(*verifyError); ok {
+			w.WriteHeader(http.StatusBadRequest)
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		fmt.Fprintf(w, "Error: %s", err)
+		return nil, false
+	}
+	return u, true
+}
 
-	version, found := release.Versions[versionStr]
-	if found {
+func (a *RestAPI) handlePostRelease(w http.ResponseWriter, r *http.Request) {
+	name, versionStr, fileext, ok := uploadVars(w, r)
+	if !ok {
+		return
+	}
+
+	// Only the reservation and the final commit are exclusive, the upload itself runs without holding the lock
+	if !a.ds.reserve(name, versionStr, "") {
 		w.WriteHeader(http.StatusConflict)
-		fmt.Fprintf(w, "Error: Version already found: %s", version)
+		fmt.Fprintf(w, "Error: Version already found: %s", versionStr)
 		return
 	}
-	fileext := filepath.Ext(filename)
-	if fileext == "" {
+	defer a.ds.unreserve(name, versionStr, "")
+
+	u, ok := a.stage(w, r)
+	if !ok {
+		return
+	}
+	defer u.remove()
+	a.commitUpload(w, r, name, versionStr, fileext, nil, r.URL.Query().Get("notes"), u)
+}
+
+func (a *RestAPI) handlePostArtifact(w http.ResponseWriter, r *http.Request) {
+	name, versionStr, fileext, ok := uploadVars(w, r)
+	if !ok {
+		return
+	}
+	vars := mux.Vars(r)
+	platform := pushr.Platform{OS: vars["os"], Arch: vars["arch"], Variant: r.URL.Query().Get("variant")}
+	if !validPlatform(platform) {
 		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprintf(w, "Error: No File extension on %q found", filename)
+		fmt.Fprintf(w, "Error: Invalid platform %q", platform.Key())
+		return
+	}
+
+	if !a.ds.reserve(name, versionStr, platform.Key()) {
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprintf(w, "Error: Artifact already found: %s %s", versionStr, platform.Key())
 		return
 	}
-	newFilename := name + "-" + versionStr + fileext
+	defer a.ds.unreserve(name, versionStr, platform.Key())
 
-	version = pushr.NewVersion()
-	version.Filename = newFilename
-	version.ContentType = mime.TypeByExtension(fileext)
-	filePath := a.ds.Filepath(version)
+	u, ok := a.stage(w, r)
+	if !ok {
+		return
+	}
+	defer u.remove()
+	a.commitUpload(w, r, name, versionStr, fileext, &platform, "", u)
+}
 
-	o, err := os.OpenFile(filePath, os.O_RDWR|os.O_CREATE, 0600)
+// commitUpload moves a verified upload into the storage and adds it to the metadata,
+// as the platform artifact if platform is not nil.
+// The caller must hold the reservation of the version or artifact.
+func (a *RestAPI) commitUpload(w http.ResponseWriter, r *http.Request, name string, versionStr string, fileext string, platform *pushr.Platform, notes string, u *stagedUpload) {
+	newFilename := storageKey(name, versionStr, platform, fileext)
+	if err := u.store(a.ds.storage, newFilename); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "Error: %s", err)
+		return
+	}
+	version := newUploadVersion(newFilename, u)
+	var err error
+	if platform != nil {
+		err = a.ds.commitArtifact(name, versionStr, &pushr.Artifact{
+			Platform:    *platform,
+			ContentType: version.ContentType,
+			Size:        version.Size,
+			Filename:    version.Filename,
+			SHA256:      version.SHA256,
+			SHA512:      version.SHA512,
+			Uploaded:    version.Uploaded,
+			Signature:   version.Signature,
+		})
+	} else {
+		version.Notes = notes
+		err = a.ds.commit(name, versionStr, version)
+	}
 	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "Error: Could not save metadata: %s", err)
+		a.ds.storage.Delete(newFilename)
+		return
+	}
+	attrs := []slog.Attr{
+		slog.String("release", name),
+		slog.String("version", versionStr),
+		slog.String("filename", newFilename),
+		slog.Int64("size", version.Size),
+		slog.String("sha256", version.SHA256),
+	}
+	if platform != nil {
+		attrs = append(attrs, slog.String("platform", platform.Key()))
+	}
+	a.audit(w, r, "upload", attrs...)
+	event := &pushr.Event{Type: pushr.EventUpload, Release: name, Version: versionStr}
+	if platform != nil {
+		event.Platform = platform.Key()
+	}
+	event.Metadata, _ = a.ds.Version(name, versionStr)
+	a.publish(event)
+	w.WriteHeader(http.StatusCreated)
+}
+
+// validPlatform reports whether all parts of p are valid identifiers, the variant is optional.
+// storageKey returns the storage name of an uploaded version file, or of its platform artifact if platform is not nil.
+// Files are nested by release and version, release names cannot contain slashes and versions are semver,
+// so files of different releases and versions never collide like the flat name-version.ext names did.
+// Files imported by migrate keep their flat names.
+func storageKey(name string, versionStr string, platform *pushr.Platform, fileext string) string {
+	filename := name + "-" + versionStr + fileext
+	if platform != nil {
+		filename = name + "-" + versionStr + "_" + strings.Replace(platform.Key(), "/", "_", -1) + fileext
+	}
+	dir := url.PathEscape(name)
+	if strings.HasPrefix(dir, ".") {
+		// Hidden files are reserved for temporary files
+		dir = "%2E" + dir[1:]
+	}
+	return dir + "/" + versionStr + "/" + url.PathEscape(filename)
+}
+
+func validPlatform(p pushr.Platform) bool {
+	return validIdentifier(p.OS) && validIdentifier(p.Arch) && (p.Variant == "" || validIdentifier(p.Variant))
+}
+
+// validIdentifier reports whether s is a valid channel name, GOOS, GOARCH or variant.
+// Identifiers are used in filenames and URLs.
+func validIdentifier(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if !(c >= 'a' && c <= 'z') && !(c >= 'A' && c <= 'Z') && !(c >= '0' && c <= '9') && c != '-' && c != '.' {
+			return false
+		}
+	}
+	return true
+}
+
+func (a *RestAPI) handleDeleteRelease(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	name, found := vars["name"]
+	if !found {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	versionStr, found := vars["version"]
+	if !found {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	deleted, _ := a.ds.Version(name, versionStr)
+	if err := a.ds.delete(name, versionStr); err == errVersionNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err == errVersionPromoted {
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprintf(w, "Error: %s", err)
+		return
+	} else if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		fmt.Fprintf(w, "Error: %s", err)
 		return
 	}
-	defer o.Close()
-	defer r.Body.Close()
-	written, err := io.Copy(o, r.Body)
-	if err != nil || written == 0 {
+	a.audit(w, r, "delete", slog.String("release", name), slog.String("version", versionStr))
+	a.publish(&pushr.Event{Type: pushr.EventDelete, Release: name, Version: versionStr, Metadata: deleted})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleYank yanks a version on POST and restores it on DELETE.
+func (a *RestAPI) handleYank(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	name, found := vars["name"]
+	if !found {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	versionStr, found := vars["version"]
+	if !found {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	yank := r.Method == "POST"
+	if err := a.ds.setYanked(name, versionStr, yank); err == errVersionNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "Error: %s", err)
+		return
+	}
+	action := pushr.EventYank
+	if !yank {
+		action = pushr.EventUnyank
+	}
+	a.audit(w, r, action, slog.String("release", name), slog.String("version", versionStr))
+	metadata, _ := a.ds.Version(name, versionStr)
+	a.publish(&pushr.Event{Type: action, Release: name, Version: versionStr, Metadata: metadata})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *RestAPI) handleGetChannel(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	name, found := vars["name"]
+	if !found {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	channel, found := a.ds.Channel(name, vars["channel"])
+	if !found {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(channel)
+}
+
+// handlePromote points a channel to the version given by the version parameter.
+func (a *RestAPI) handlePromote(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	name, found := vars["name"]
+	if !found {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	channel := vars["channel"]
+	if !validIdentifier(channel) {
 		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprintf(w, "Error: Written %d, %s", written, err)
-		os.Remove(o.Name())
+		fmt.Fprintf(w, "Error: Invalid channel %q", channel)
 		return
 	}
-	version.Size = written
-	release.Versions[versionStr] = version
-	w.WriteHeader(http.StatusCreated)
+	versionStr := r.FormValue("version")
+	if _, err := semver.New(versionStr); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Error processing version: %s", err)
+		return
+	}
+
+	if err := a.ds.promote(name, channel, versionStr, r.RemoteAddr); err == errVersionNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err == errVersionYanked {
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprintf(w, "Error: %s", err)
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "Error: %s", err)
+		return
+	}
+	a.audit(w, r, "promote", slog.String("release", name), slog.String("channel", channel), slog.String("version", versionStr))
+	metadata, _ := a.ds.Version(name, versionStr)
+	a.publish(&pushr.Event{Type: pushr.EventPromote, Release: name, Version: versionStr, Channel: channel, Metadata: metadata})
+	w.WriteHeader(http.StatusNoContent)
 }
 
-func (a *RestAPI) readAccess(handler http.Handler) http.Handler {
-	// Allow access if no readToken is set
-	if a.readToken == "" {
-		return handler
+// handleUnpromote removes the version pointer of a channel, which then follows the newest version again.
+func (a *RestAPI) handleUnpromote(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	name, found := vars["name"]
+	if !found {
+		w.WriteHeader(http.StatusNotFound)
+		return
 	}
+	channel := vars["channel"]
+	previous, err := a.ds.unpromote(name, channel, r.RemoteAddr)
+	if err == errChannelNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "Error: %s", err)
+		return
+	}
+	a.audit(w, r, "unpromote", slog.String("release", name), slog.String("channel", channel), slog.String("version", previous))
+	metadata, _ := a.ds.Version(name, previous)
+	a.publish(&pushr.Event{Type: pushr.EventUnpromote, Release: name, Version: previous, Channel: channel, Metadata: metadata})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// access allows the request if its token grants scope on the release of the route.
+// For routes without release the scope on any release suffices, their handlers check the release.
+func (a *RestAPI) access(scope string, handler http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.Header.Get("X-PUSHR-TOKEN") == a.readToken || r.FormValue("token") == a.readToken {
-			handler.ServeHTTP(w, r)
-		} else {
-			w.WriteHeader(http.StatusUnauthorized)
+		if !a.authorize(w, r, scope, mux.Vars(r)["name"]) {
+			return
 		}
+		handler.ServeHTTP(w, r)
 	})
-
 }
 
-func (a *RestAPI) writeAccess(handler http.Handler) http.Handler {
-	if a.writeToken == "" {
-		return handler
-	}
+// accessAll allows the request if its token grants scope without release restriction, for endpoints
+// affecting or exposing all releases. Tokens limited to some releases could otherwise create tokens
+// for all releases or read the metrics and webhook deliveries of other releases.
+func (a *RestAPI) accessAll(scope string, handler http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.Header.Get("X-PUSHR-TOKEN") == a.writeToken || r.FormValue("token") == a.writeToken {
-			handler.ServeHTTP(w, r)
-		} else {
-			w.WriteHeader(http.StatusUnauthorized)
+		if !a.authorize(w, r, scope, allReleases) {
+			return
 		}
+		handler.ServeHTTP(w, r)
 	})
 }
+
+// authorize checks the token or the client certificate of the request, writing the error response if access is denied.
+func (a *RestAPI) authorize(w http.ResponseWriter, r *http.Request, scope string, release string) bool {
+	token := a.requestToken(r)
+	err := a.tokens.check(token, scope, release)
+	identified(w, a.tokens.identity(token))
+	if name, ok := clientCertName(r); ok && token == "" && err != nil {
+		err = a.tokens.checkName(name, scope, release)
+		identified(w, "cert:"+name)
+	}
+	switch err {
+	case nil:
+		return true
+	case errForbidden:
+		w.WriteHeader(http.StatusForbidden)
+	default:
+		w.WriteHeader(http.StatusUnauthorized)
+	}
+	return false
+}
+
+// requestToken returns the token of the X-PUSHR-TOKEN header or, if enabled, the token parameter.
+func (a *RestAPI) requestToken(r *http.Request) string {
+	if token := r.Header.Get("X-PUSHR-TOKEN"); token != "" || !a.queryTokens {
+		return token
+	}
+	return r.FormValue("token")
+}
+
+func (a *RestAPI) handleListTokens(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(a.tokens.list())
+}
+
+// handleCreateToken creates a token, the response contains the secret which is not stored.
+func (a *RestAPI) handleCreateToken(w http.ResponseWriter, r *http.Request) {
+	var req pushr.Token
+	if err := json.NewDecoder(io.LimitReader(r.Body, 64*1024)).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Error: %s", err)
+		return
+	}
+	token, err := a.tokens.create(&req)
+	if err == errTokenExists {
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprintf(w, "Error: %s", err)
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Error: %s", err)
+		return
+	}
+	a.audit(w, r, "token.create", slog.String("token", token.Name), slog.Any("scopes", token.Scopes), slog.Any("releases", token.Releases))
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(token)
+}
+
+func (a *RestAPI) handleRevokeToken(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["token"]
+	if err := a.tokens.revoke(name); err == errTokenNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "Error: %s", err)
+		return
+	}
+	a.audit(w, r, "token.revoke", slog.String("token", name))
+	w.WriteHeader(http.StatusNoContent)
+}
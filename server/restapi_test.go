@@ -0,0 +1,547 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"github.com/blang/pushr"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestServer starts a RestAPI without tokens on an empty fs storage.
+func newTestServer(t testing.TB) (*RestAPI, *httptest.Server, func()) {
+	dataDir, err := ioutil.TempDir("", "pushrtest")
+	if err != nil {
+		t.Fatalf("Could not create test data dir: %s", err)
+	}
+	st, err := newFSStorage(dataDir)
+	if err != nil {
+		t.Fatalf("Could not create storage: %s", err)
+	}
+	ds, err := loadDataStore(st)
+	if err != nil {
+		t.Fatalf("Could not load data store: %s", err)
+	}
+	tokens, err := loadTokenStore("", "", "")
+	if err != nil {
+		t.Fatalf("Could not create token store: %s", err)
+	}
+	a := NewRestAPI(tokens, ds)
+	a.urlKey = []byte("0123456789abcdef0123456789abcdef")
+	a.stagingDir = filepath.Join(dataDir, ".staging")
+	if err := cleanStagingDir(a.stagingDir); err != nil {
+		t.Fatalf("Could not create staging dir: %s", err)
+	}
+	ts := httptest.NewServer(a)
+	return a, ts, func() {
+		ts.Close()
+		os.RemoveAll(dataDir)
+	}
+}
+
+func upload(t testing.TB, url string, body io.Reader) *http.Response {
+	resp, err := http.Post(url, "application/octet-stream", body)
+	if err != nil {
+		t.Fatalf("Upload failed: %s", err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+// startSlowUpload starts an upload which blocks until the returned writer is closed.
+// It returns once the server reserved the version.
+func startSlowUpload(t testing.TB, a *RestAPI, url string, name string, versionStr string) (*io.PipeWriter, chan *http.Response) {
+	pr, pw := io.Pipe()
+	done := make(chan *http.Response, 1)
+	go func() {
+		done <- upload(t, url, pr)
+	}()
+	pw.Write([]byte("SLOW"))
+	for i := 0; ; i++ {
+		a.ds.RLock()
+		reserved := a.ds.pending[name+"/"+versionStr]
+		a.ds.RUnlock()
+		if reserved {
+			break
+		}
+		if i > 1000 {
+			t.Fatal("Upload did not start")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	return pw, done
+}
+
+func TestUploadDoesNotBlockReaders(t *testing.T) {
+	a, ts, cleanup := newTestServer(t)
+	defer cleanup()
+
+	if resp := upload(t, ts.URL+"/releases/test/1.0.0/test.zip", strings.NewReader("TESTOUTPUT")); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Upload failed with status %d", resp.StatusCode)
+	}
+
+	pw, done := startSlowUpload(t, a, ts.URL+"/releases/test/2.0.0/test.zip", "test", "2.0.0")
+
+	// Readers proceed while the upload is running
+	readDone := make(chan error, 1)
+	go func() {
+		for _, url := range []string{"/releases/test", "/releases/test/1.0.0"} {
+			resp, err := http.Get(ts.URL + url)
+			if err != nil {
+				readDone <- err
+				return
+			}
+			b, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Errorf("Read of %s failed with status %d: %s", url, resp.StatusCode, b)
+			}
+		}
+		readDone <- nil
+	}()
+	select {
+	case err := <-readDone:
+		if err != nil {
+			t.Fatalf("Read failed: %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Readers blocked by running upload")
+	}
+
+	// A concurrent upload of the same version conflicts
+	if resp := upload(t, ts.URL+"/releases/test/2.0.0/test.zip", strings.NewReader("OTHER")); resp.StatusCode != http.StatusConflict {
+		t.Errorf("Concurrent upload of reserved version returned %d, expected 409", resp.StatusCode)
+	}
+
+	pw.Close()
+	if resp := <-done; resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Slow upload failed with status %d", resp.StatusCode)
+	}
+	if v, found := a.ds.Version("test", "2.0.0"); !found || v.Size != 4 {
+		t.Errorf("Slow upload not committed: %v", v)
+	}
+	if len(a.ds.pending) != 0 {
+		t.Errorf("Reservations left after upload: %v", a.ds.pending)
+	}
+}
+
+// BenchmarkReadsDuringUpload measures downloads while an upload is stalled mid-transfer.
+// With the upload holding the DataStore lock this benchmark would never finish.
+func BenchmarkReadsDuringUpload(b *testing.B) {
+	a, ts, cleanup := newTestServer(b)
+	defer cleanup()
+
+	if resp := upload(b, ts.URL+"/releases/test/1.0.0/test.zip", strings.NewReader("TESTOUTPUT")); resp.StatusCode != http.StatusCreated {
+		b.Fatalf("Upload failed with status %d", resp.StatusCode)
+	}
+	pw, done := startSlowUpload(b, a, ts.URL+"/releases/test/2.0.0/test.zip", "test", "2.0.0")
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			resp, err := http.Get(ts.URL + "/releases/test/1.0.0")
+			if err != nil {
+				b.Errorf("Download failed: %s", err)
+				return
+			}
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				b.Errorf("Download failed with status %d", resp.StatusCode)
+				return
+			}
+		}
+	})
+	b.StopTimer()
+
+	pw.Close()
+	<-done
+}
+
+func TestDeleteAndYank(t *testing.T) {
+	a, ts, cleanup := newTestServer(t)
+	defer cleanup()
+
+	for _, v := range []string{"1.0.0", "1.1.0"} {
+		if resp := upload(t, ts.URL+"/releases/test/"+v+"/test.zip", strings.NewReader("TESTOUTPUT")); resp.StatusCode != http.StatusCreated {
+			t.Fatalf("Upload failed with status %d", resp.StatusCode)
+		}
+	}
+	request := func(method string, url string) int {
+		req, _ := http.NewRequest(method, ts.URL+url, nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Request failed: %s", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	listed := func(query string) map[string]*pushr.Version {
+		resp, err := http.Get(ts.URL + "/releases/test" + query)
+		if err != nil {
+			t.Fatalf("Request failed: %s", err)
+		}
+		defer resp.Body.Close()
+		var r pushr.Release
+		json.NewDecoder(resp.Body).Decode(&r)
+		return r.Versions
+	}
+
+	// Yank
+	if code := request("POST", "/releases/test/1.1.0/yank"); code != http.StatusNoContent {
+		t.Fatalf("Yank returned %d", code)
+	}
+	if versions := listed(""); len(versions) != 1 || versions["1.0.0"] == nil {
+		t.Errorf("Yanked version listed: %v", versions)
+	}
+	if versions := listed("?yanked=true"); len(versions) != 2 || !versions["1.1.0"].Yanked {
+		t.Errorf("Yanked version not listed on request: %v", versions)
+	}
+	if code := request("GET", "/releases/test/1.1.0"); code != http.StatusOK {
+		t.Errorf("Download of yanked version returned %d", code)
+	}
+	if code := request("DELETE", "/releases/test/1.1.0/yank"); code != http.StatusNoContent {
+		t.Fatalf("Unyank returned %d", code)
+	}
+	if versions := listed(""); len(versions) != 2 {
+		t.Errorf("Unyanked version not listed: %v", versions)
+	}
+
+	// Delete
+	if code := request("DELETE", "/releases/test/1.0.0"); code != http.StatusNoContent {
+		t.Fatalf("Delete returned %d", code)
+	}
+	if code := request("GET", "/releases/test/1.0.0"); code != http.StatusNotFound {
+		t.Errorf("Download of deleted version returned %d", code)
+	}
+	if _, err := a.ds.storage.Stat("test/1.0.0/test-1.0.0.zip"); !os.IsNotExist(err) {
+		t.Errorf("File of deleted version not removed: %v", err)
+	}
+	if code := request("DELETE", "/releases/test/1.0.0"); code != http.StatusNotFound {
+		t.Errorf("Delete of deleted version returned %d", code)
+	}
+	if code := request("POST", "/releases/test/1.0.0/yank"); code != http.StatusNotFound {
+		t.Errorf("Yank of deleted version returned %d", code)
+	}
+}
+
+func TestStorageKeysDoNotCollide(t *testing.T) {
+	_, ts, cleanup := newTestServer(t)
+	defer cleanup()
+
+	// Both were stored as a-1.0.0-1.0.0.zip
+	for path, content := range map[string]string{"a-1.0.0/1.0.0": "FIRST", "a/1.0.0-1.0.0": "SECOND"} {
+		if resp := upload(t, ts.URL+"/releases/"+path+"/test.zip", strings.NewReader(content)); resp.StatusCode != http.StatusCreated {
+			t.Fatalf("Upload of %s failed with status %d", path, resp.StatusCode)
+		}
+	}
+	get := func(path string) (int, string) {
+		resp, err := http.Get(ts.URL + "/releases/" + path)
+		if err != nil {
+			t.Fatalf("Request failed: %s", err)
+		}
+		defer resp.Body.Close()
+		b, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(b)
+	}
+	if code, body := get("a-1.0.0/1.0.0"); code != http.StatusOK || body != "FIRST" {
+		t.Errorf("Download of a-1.0.0 returned %d: %s", code, body)
+	}
+	c := pushr.NewClient(ts.URL, "", "")
+	if err := c.Delete("a", "1.0.0-1.0.0"); err != nil {
+		t.Fatalf("Delete failed: %s", err)
+	}
+	if code, body := get("a-1.0.0/1.0.0"); code != http.StatusOK || body != "FIRST" {
+		t.Errorf("Download of a-1.0.0 after deleting the other version returned %d: %s", code, body)
+	}
+	if err := c.Delete("a-1.0.0", "1.0.0"); err != nil {
+		t.Errorf("Delete failed: %s", err)
+	}
+}
+
+func TestLatest(t *testing.T) {
+	_, ts, cleanup := newTestServer(t)
+	defer cleanup()
+
+	for _, v := range []string{"1.0.0", "1.1.0-beta", "1.2.0"} {
+		if resp := upload(t, ts.URL+"/releases/test/"+v+"/test.zip", strings.NewReader("TESTOUTPUT "+v)); resp.StatusCode != http.StatusCreated {
+			t.Fatalf("Upload failed with status %d", resp.StatusCode)
+		}
+	}
+	req, _ := http.NewRequest("POST", ts.URL+"/releases/test/1.2.0/yank", nil)
+	if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("Yank failed: %v", err)
+	}
+
+	c := pushr.NewClient(ts.URL, "", "")
+	for channel, expected := range map[string]string{"": "1.0.0", "beta": "1.1.0-beta"} {
+		v, versionStr, err := c.LatestVersion("test", channel)
+		if err != nil || versionStr != expected || v.Filename != "test/"+expected+"/test-"+expected+".zip" {
+			t.Errorf("Latest in channel %q: expected %s, got %s %v (%v)", channel, expected, versionStr, v, err)
+		}
+	}
+	if _, _, err := c.LatestVersion("other", ""); !errors.Is(err, pushr.ErrNotFound) {
+		t.Errorf("Expected not found error for unknown release, got %v", err)
+	}
+
+	// Plain text for shell scripts
+	req, _ = http.NewRequest("GET", ts.URL+"/releases/test/latest?channel=beta", nil)
+	req.Header.Set("Accept", "text/plain")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %s", err)
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(b) != "1.1.0-beta\n" {
+		t.Errorf("Wrong plain text latest version: %q", string(b))
+	}
+
+	// Download redirect
+	resp, err = http.Get(ts.URL + "/releases/test/latest/download?channel=beta")
+	if err != nil {
+		t.Fatalf("Request failed: %s", err)
+	}
+	b, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.Request.URL.Path != "/releases/test/1.1.0-beta" || resp.Request.URL.Query().Get("channel") != "beta" || string(b) != "TESTOUTPUT 1.1.0-beta" {
+		t.Errorf("Wrong download of latest version from %s: %q", resp.Request.URL, string(b))
+	}
+	if resp, _ := http.Get(ts.URL + "/releases/other/latest/download"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Latest download of unknown release returned %d", resp.StatusCode)
+	}
+}
+
+func TestArtifacts(t *testing.T) {
+	a, ts, cleanup := newTestServer(t)
+	defer cleanup()
+
+	for _, p := range []string{"linux/amd64/test.tar.gz", "darwin/arm64/test.tar.gz", "linux/arm/test.tar.gz?variant=v7"} {
+		if resp := upload(t, ts.URL+"/releases/test/1.0.0/"+p, strings.NewReader("ARTIFACT "+p)); resp.StatusCode != http.StatusCreated {
+			t.Fatalf("Upload of %s failed with status %d", p, resp.StatusCode)
+		}
+	}
+	if resp := upload(t, ts.URL+"/releases/test/1.0.0/linux/amd64/test.tar.gz", strings.NewReader("OTHER")); resp.StatusCode != http.StatusConflict {
+		t.Errorf("Duplicate artifact upload returned %d, expected 409", resp.StatusCode)
+	}
+	if resp := upload(t, ts.URL+"/releases/test/1.0.0/linux/amd_64/test.tar.gz", strings.NewReader("OTHER")); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Upload with invalid platform returned %d, expected 400", resp.StatusCode)
+	}
+
+	// Artifact only version has no platform independent file
+	if resp, _ := http.Get(ts.URL + "/releases/test/1.0.0"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Download of artifact only version returned %d", resp.StatusCode)
+	}
+	if resp := upload(t, ts.URL+"/releases/test/1.0.0/test.zip", strings.NewReader("GENERIC")); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Upload of generic file failed with status %d", resp.StatusCode)
+	}
+
+	v, found := a.ds.Version("test", "1.0.0")
+	if !found || v.Filename != "test/1.0.0/test-1.0.0.zip" || len(v.Artifacts) != 3 {
+		t.Fatalf("Wrong version metadata: %v", v)
+	}
+	if artifact := v.Artifacts["linux/arm/v7"]; artifact == nil || artifact.Filename != "test/1.0.0/test-1.0.0_linux_arm_v7.gz" || artifact.SHA256 == "" {
+		t.Errorf("Wrong artifact metadata: %v", artifact)
+	}
+
+	for url, expected := range map[string]string{
+		"/releases/test/1.0.0":                                        "GENERIC",
+		"/releases/test/1.0.0/darwin/arm64":                           "ARTIFACT darwin/arm64/test.tar.gz",
+		"/releases/test/1.0.0/linux/arm?variant=v7":                   "ARTIFACT linux/arm/test.tar.gz?variant=v7",
+		"/releases/test/1.0.0/windows/amd64":                          "",
+		"/releases/test/1.0.0/linux/arm?variant=v6":                   "",
+		"/releases/test/latest/download?os=darwin&arch=arm64":         "ARTIFACT darwin/arm64/test.tar.gz",
+		"/releases/test/latest/download?os=linux&arch=arm&variant=v7": "ARTIFACT linux/arm/test.tar.gz?variant=v7",
+		"/releases/test/latest/download?os=windows&arch=amd64":        "",
+	} {
+		resp, err := http.Get(ts.URL + url)
+		if err != nil {
+			t.Fatalf("Request failed: %s", err)
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if expected == "" {
+			if resp.StatusCode != http.StatusNotFound {
+				t.Errorf("Download of missing artifact %s returned %d", url, resp.StatusCode)
+			}
+			continue
+		}
+		if resp.StatusCode != http.StatusOK || string(b) != expected || resp.Header.Get("Digest") == "" {
+			t.Errorf("Wrong download of %s: %d %q", url, resp.StatusCode, string(b))
+		}
+	}
+
+	// Delete removes all files
+	req, _ := http.NewRequest("DELETE", ts.URL+"/releases/test/1.0.0", nil)
+	if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if files, _ := a.ds.storage.List(); len(files) != 1 || files[0].Name != indexFilename {
+		t.Errorf("Files left after delete: %v", files)
+	}
+}
+
+func TestChannels(t *testing.T) {
+	a, ts, cleanup := newTestServer(t)
+	defer cleanup()
+
+	for _, v := range []string{"1.2.0", "1.3.0-beta.4", "1.4.0-beta.1"} {
+		if resp := upload(t, ts.URL+"/releases/test/"+v+"/test.zip", strings.NewReader("TESTOUTPUT "+v)); resp.StatusCode != http.StatusCreated {
+			t.Fatalf("Upload failed with status %d", resp.StatusCode)
+		}
+	}
+	c := pushr.NewClient(ts.URL, "", "")
+	if err := c.Promote("test", "stable", "1.3.0-beta.4"); err != nil {
+		t.Fatalf("Promote failed: %s", err)
+	}
+	if err := c.Promote("test", "nightly", "1.4.0-beta.1"); err != nil {
+		t.Fatalf("Promote failed: %s", err)
+	}
+	for channel, expected := range map[string]string{"": "1.3.0-beta.4", "nightly": "1.4.0-beta.1", "beta": "1.4.0-beta.1"} {
+		if _, versionStr, err := c.LatestVersion("test", channel); err != nil || versionStr != expected {
+			t.Errorf("Latest in channel %q: expected %s, got %s (%v)", channel, expected, versionStr, err)
+		}
+	}
+
+	// Promoting again is recorded in the history
+	if err := c.Promote("test", "stable", "1.2.0"); err != nil {
+		t.Fatalf("Promote failed: %s", err)
+	}
+	ch, err := c.Channel("test", "stable")
+	if err != nil {
+		t.Fatalf("Reading channel failed: %s", err)
+	}
+	if ch.Version != "1.2.0" || len(ch.History) != 2 || ch.History[1].Previous != "1.3.0-beta.4" || ch.History[1].Remote == "" {
+		t.Errorf("Wrong channel history: %v", ch)
+	}
+
+	for _, test := range []struct {
+		channel  string
+		version  string
+		expected error
+	}{
+		{"stable", "9.9.9", pushr.ErrNotFound},
+		{"stable", "invalid", pushr.ErrBadRequest},
+		{"sta_ble", "1.2.0", pushr.ErrBadRequest},
+	} {
+		if err := c.Promote("test", test.channel, test.version); !errors.Is(err, test.expected) {
+			t.Errorf("Promote of %s to %s: expected %v, got %v", test.version, test.channel, test.expected, err)
+		}
+	}
+	if err := c.Yank("test", "1.4.0-beta.1"); err != nil {
+		t.Fatalf("Yank failed: %s", err)
+	}
+	if err := c.Promote("test", "beta", "1.4.0-beta.1"); !errors.Is(err, pushr.ErrConflict) {
+		t.Errorf("Promote of yanked version: expected conflict, got %v", err)
+	}
+
+	// Channels are persisted
+	ds, err := loadDataStore(a.ds.storage)
+	if err != nil {
+		t.Fatalf("Could not reload data store: %s", err)
+	}
+	if ch, found := ds.Channel("test", "stable"); !found || ch.Version != "1.2.0" || len(ch.History) != 2 {
+		t.Errorf("Channel not persisted: %v", ch)
+	}
+
+	// Channels never point to deleted versions
+	if err := c.Delete("test", "1.2.0"); !errors.Is(err, pushr.ErrConflict) {
+		t.Errorf("Delete of promoted version: expected conflict, got %v", err)
+	}
+	if err := c.Promote("test", "stable", "1.3.0-beta.4"); err != nil {
+		t.Fatalf("Promote failed: %s", err)
+	}
+	if err := c.Delete("test", "1.2.0"); err != nil {
+		t.Errorf("Delete of no longer promoted version failed: %s", err)
+	}
+	if ch, err := c.Channel("test", "stable"); err != nil || ch.Version != "1.3.0-beta.4" || len(ch.History) != 3 {
+		t.Errorf("Wrong channel after delete: %v (%v)", ch, err)
+	}
+
+	// Removing the pointer releases the version, the channel follows the newest version again
+	if err := c.Unpromote("test", "stable"); err != nil {
+		t.Fatalf("Unpromote failed: %s", err)
+	}
+	if err := c.Unpromote("test", "stable"); !errors.Is(err, pushr.ErrNotFound) {
+		t.Errorf("Unpromote of removed pointer: expected not found, got %v", err)
+	}
+	if err := c.Unpromote("test", "unknown"); !errors.Is(err, pushr.ErrNotFound) {
+		t.Errorf("Unpromote of unknown channel: expected not found, got %v", err)
+	}
+	ch, err = c.Channel("test", "stable")
+	if err != nil || ch.Version != "" || len(ch.History) != 4 || ch.History[3].Version != "" || ch.History[3].Previous != "1.3.0-beta.4" {
+		t.Errorf("Wrong channel after unpromote: %v (%v)", ch, err)
+	}
+	if err := c.Delete("test", "1.3.0-beta.4"); err != nil {
+		t.Errorf("Delete of unpromoted version failed: %s", err)
+	}
+	if _, versionStr, err := c.LatestVersion("test", "stable"); !errors.Is(err, pushr.ErrNotFound) {
+		t.Errorf("Latest of unpromoted channel without stable versions: expected not found, got %s (%v)", versionStr, err)
+	}
+}
+
+func TestSignedUploads(t *testing.T) {
+	a, ts, cleanup := newTestServer(t)
+	defer cleanup()
+	dir, err := ioutil.TempDir("", "pushrtest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	pub, key, _ := ed25519.GenerateKey(nil)
+	otherPub, _, _ := ed25519.GenerateKey(nil)
+	c := pushr.NewClient(ts.URL, "", "", pushr.WithSigningKey(key), pushr.WithChunkedUpload(100, 30))
+	if err := c.Upload("test", "1.0.0", "test.zip", strings.NewReader("SIGNED")); err != nil {
+		t.Fatalf("Signed upload failed: %s", err)
+	}
+	content := strings.Repeat("0123456789", 20)
+	if err := c.UploadPlatform("test", "1.0.0", pushr.Platform{OS: "linux", Arch: "amd64"}, "test.zip", strings.NewReader(content)); err != nil {
+		t.Fatalf("Signed chunked upload failed: %s", err)
+	}
+	if err := pushr.NewClient(ts.URL, "", "").Upload("test", "2.0.0", "test.zip", strings.NewReader("UNSIGNED")); err != nil {
+		t.Fatalf("Upload failed: %s", err)
+	}
+	if v, _ := a.ds.Version("test", "1.0.0"); v.Signature == "" || v.Artifacts["linux/amd64"].Signature == "" {
+		t.Fatalf("Signatures not stored: %v", v)
+	}
+
+	verifying := pushr.NewClient(ts.URL, "", "", pushr.WithPublicKeys(otherPub, pub))
+	if err := verifying.Download("test", "1.0.0", filepath.Join(dir, "main")); err != nil {
+		t.Errorf("Download of signed version failed: %s", err)
+	}
+	if err := verifying.DownloadFor("test", "1.0.0", "linux", "amd64", filepath.Join(dir, "artifact")); err != nil {
+		t.Errorf("Download of signed artifact failed: %s", err)
+	}
+	if err := verifying.Download("test", "2.0.0", filepath.Join(dir, "unsigned")); err != pushr.ErrUnsigned {
+		t.Errorf("Expected unsigned error, got %v", err)
+	}
+	untrusting := pushr.NewClient(ts.URL, "", "", pushr.WithPublicKeys(otherPub))
+	if err := untrusting.Download("test", "1.0.0", filepath.Join(dir, "untrusted")); err != pushr.ErrInvalidSignature {
+		t.Errorf("Expected invalid signature, got %v", err)
+	}
+	for _, name := range []string{"unsigned", "untrusted", "untrusted.part"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+			t.Errorf("File %s of unverified download left", name)
+		}
+	}
+
+	req, _ := http.NewRequest("POST", ts.URL+"/releases/test/3.0.0/test.zip", strings.NewReader("TEST"))
+	req.Header.Set(pushr.SignatureHeader, "invalid")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Upload with malformed signature returned %d", resp.StatusCode)
+	}
+}
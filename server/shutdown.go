@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Default time in-flight requests get to finish on shutdown
+const defaultShutdownTimeout = 30 * time.Second
+
+// uploadTracker counts running uploads and rejects new ones once the server is draining.
+type uploadTracker struct {
+	sync.Mutex
+	draining bool
+	inFlight int
+	running  sync.WaitGroup
+}
+
+// uploading tracks requests writing to the staging dir or the storage.
+// While the server shuts down, they are rejected with 503 Service Unavailable.
+func (a *RestAPI) uploading(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		a.uploads.Lock()
+		if a.uploads.draining {
+			a.uploads.Unlock()
+			w.Header().Set("Retry-After", "30")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprint(w, "Error: Server is shutting down")
+			return
+		}
+		a.uploads.running.Add(1)
+		a.uploads.inFlight++
+		a.uploads.Unlock()
+		defer func() {
+			a.uploads.Lock()
+			a.uploads.inFlight--
+			a.uploads.Unlock()
+			a.uploads.running.Done()
+		}()
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// closeUploadSessions discards all resumable uploads, their chunks are lost with the staging dir.
+func (a *RestAPI) closeUploadSessions() {
+	a.sessions.Lock()
+	sessions := make([]*uploadSession, 0, len(a.sessions.sessions))
+	for _, session := range a.sessions.sessions {
+		sessions = append(sessions, session)
+	}
+	a.sessions.Unlock()
+
+	for _, session := range sessions {
+		session.Lock()
+		a.closeSession(session)
+		session.Unlock()
+	}
+	if len(sessions) > 0 {
+		log.Printf("Discarded %d incomplete upload sessions\n", len(sessions))
+	}
+}
+
+// shutdown stops accepting uploads and connections and waits up to timeout for in-flight requests.
+// Requests still running after the timeout are cut off, which makes running uploads fail
+// and discard their staged files. Uploads are waited for in any case, so no upload is left half-committed.
+// It returns an error if requests had to be cut off.
+func shutdown(srv *http.Server, a *RestAPI, timeout time.Duration) error {
+	a.uploads.Lock()
+	a.uploads.draining = true
+	a.uploads.Unlock()
+	// Event streams and waiting release listings would keep the shutdown waiting for the timeout
+	a.events.close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	err := srv.Shutdown(ctx)
+	if err != nil {
+		srv.Close()
+		err = fmt.Errorf("Requests still running after %s: %s", timeout, err)
+	}
+	a.uploads.running.Wait()
+	a.closeUploadSessions()
+	a.webhooks.close()
+	if serr := a.stats.save(); serr != nil {
+		log.Printf("Could not save download statistics: %s", serr)
+	}
+	return err
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShutdownDrainsUploads(t *testing.T) {
+	a, ts, cleanup := newTestServer(t)
+	defer cleanup()
+
+	pw, done := startSlowUpload(t, a, ts.URL+"/releases/test/1.0.0/test.zip", "test", "1.0.0")
+	shutdownDone := make(chan error, 1)
+	go func() {
+		shutdownDone <- shutdown(ts.Config, a, 5*time.Second)
+	}()
+
+	for i := 0; ; i++ {
+		a.uploads.Lock()
+		draining := a.uploads.draining
+		a.uploads.Unlock()
+		if draining {
+			break
+		}
+		if i > 1000 {
+			t.Fatal("Shutdown did not start")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// New uploads are rejected while draining
+	rec := httptest.NewRecorder()
+	a.ServeHTTP(rec, httptest.NewRequest("POST", "/releases/test/2.0.0/test.zip", strings.NewReader("TEST")))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("Upload during shutdown returned %d", rec.Code)
+	}
+
+	pw.Write([]byte("REST"))
+	pw.Close()
+	if resp := <-done; resp.StatusCode != http.StatusCreated {
+		t.Errorf("In-flight upload failed with status %d", resp.StatusCode)
+	}
+	if err := <-shutdownDone; err != nil {
+		t.Errorf("Shutdown failed: %s", err)
+	}
+	if v, found := a.ds.Version("test", "1.0.0"); !found || v.Size != 8 {
+		t.Errorf("In-flight upload not committed: %v", v)
+	}
+	if _, found := a.ds.Version("test", "2.0.0"); found {
+		t.Error("Upload during shutdown committed")
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	a, ts, cleanup := newTestServer(t)
+	defer cleanup()
+
+	create := httptest.NewRecorder()
+	a.ServeHTTP(create, httptest.NewRequest("POST", "/uploads", strings.NewReader(`{"release":"test","version":"2.0.0","filename":"test.zip","size":10}`)))
+	if create.Code != http.StatusCreated {
+		t.Fatalf("Could not create upload session: %d", create.Code)
+	}
+
+	// The connection of the stalled upload is cut off, so the client gets an error instead of a response
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	go func() {
+		if resp, err := http.Post(ts.URL+"/releases/test/1.0.0/test.zip", "application/octet-stream", pr); err == nil {
+			resp.Body.Close()
+		}
+	}()
+	pw.Write([]byte("SLOW"))
+	for i := 0; ; i++ {
+		a.ds.RLock()
+		reserved := a.ds.pending["test/1.0.0"]
+		a.ds.RUnlock()
+		if reserved {
+			break
+		}
+		if i > 1000 {
+			t.Fatal("Upload did not start")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	if err := shutdown(ts.Config, a, 100*time.Millisecond); err == nil {
+		t.Error("Shutdown with stalled upload succeeded")
+	}
+	if _, found := a.ds.Version("test", "1.0.0"); found {
+		t.Error("Stalled upload committed")
+	}
+	if len(a.ds.pending) != 0 || len(a.sessions.sessions) != 0 {
+		t.Errorf("Uploads left after shutdown: %v %d", a.ds.pending, len(a.sessions.sessions))
+	}
+	if files, _ := ioutil.ReadDir(a.stagingDir); len(files) != 0 {
+		t.Errorf("Staging files left: %d", len(files))
+	}
+}
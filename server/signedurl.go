@@ -0,0 +1,160 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/blang/pushr"
+	"github.com/gorilla/mux"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultLinkExpiry = time.Hour
+	maxLinkExpiry     = 7 * 24 * time.Hour
+
+	// Expiry of the links the latest download redirect uses instead of a token parameter
+	redirectLinkExpiry = 5 * time.Minute
+)
+
+// loadURLKey reads the key signing download links from path, generating it on first use.
+// The key is kept on disk, so links stay valid across restarts.
+func loadURLKey(path string) ([]byte, error) {
+	b, err := ioutil.ReadFile(path)
+	if err == nil {
+		key, err := hex.DecodeString(string(b))
+		if err != nil || len(key) < 32 {
+			return nil, fmt.Errorf("Invalid URL signing key in %s", path)
+		}
+		return key, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	key := newURLKey()
+	if err := ioutil.WriteFile(path, []byte(hex.EncodeToString(key)), 0600); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// newURLKey returns a random key for signing download links.
+func newURLKey() []byte {
+	key := make([]byte, 32)
+	rand.Read(key)
+	return key
+}
+
+// signURL returns the signature of a download link of path and artifact variant expiring at expires.
+func (a *RestAPI) signURL(path string, variant string, expires int64) string {
+	mac := hmac.New(sha256.New, a.urlKey)
+	mac.Write([]byte(path + "\n" + variant + "\n" + strconv.FormatInt(expires, 10)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// signedURL returns path with variant, expiry and signature parameters.
+func (a *RestAPI) signedURL(path string, variant string, expires time.Time) string {
+	query := url.Values{}
+	if variant != "" {
+		query.Set("variant", variant)
+	}
+	query.Set("expires", strconv.FormatInt(expires.Unix(), 10))
+	query.Set("signature", a.signURL(path, variant, expires.Unix()))
+	return path + "?" + query.Encode()
+}
+
+// verifySignedURL reports whether the request carries a valid, unexpired signature for its path.
+func (a *RestAPI) verifySignedURL(r *http.Request) bool {
+	query := r.URL.Query()
+	expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return false
+	}
+	signature, err := hex.DecodeString(query.Get("signature"))
+	if err != nil {
+		return false
+	}
+	expected, _ := hex.DecodeString(a.signURL(r.URL.Path, query.Get("variant"), expires))
+	return hmac.Equal(signature, expected)
+}
+
+// signedAccess serves requests with a signature parameter if the signature is valid,
+// all other requests need a token granting read access.
+func (a *RestAPI) signedAccess(handler http.Handler) http.Handler {
+	tokenAccess := a.access(pushr.ScopeRead, handler)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("signature") == "" {
+			tokenAccess.ServeHTTP(w, r)
+			return
+		}
+		if !a.verifySignedURL(r) {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, "Error: Invalid or expired signature")
+			return
+		}
+		identified(w, "signed-url")
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// handleCreateLink mints a signed download link for a version, valid for the duration of the expires parameter.
+// With the os and arch parameters, the link points to the platform artifact.
+func (a *RestAPI) handleCreateLink(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	name, found := vars["name"]
+	if !found {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	versionStr, found := vars["version"]
+	if !found {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	expiry := defaultLinkExpiry
+	if s := r.URL.Query().Get("expires"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil || d <= 0 || d > maxLinkExpiry {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "Error: Invalid expiry %q, must be a duration up to %s", s, maxLinkExpiry)
+			return
+		}
+		expiry = d
+	}
+
+	version, found := a.ds.Version(name, versionStr)
+	if !found {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	path := "/releases/" + name + "/" + versionStr
+	variant := ""
+	if goos := r.URL.Query().Get("os"); goos != "" {
+		platform := pushr.Platform{OS: goos, Arch: r.URL.Query().Get("arch"), Variant: r.URL.Query().Get("variant")}
+		if _, found := version.Artifacts[platform.Key()]; !found {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		path += "/" + platform.OS + "/" + platform.Arch
+		variant = platform.Variant
+	} else if version.Filename == "" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	expires := time.Now().Add(expiry).Truncate(time.Second)
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(&pushr.SignedURL{
+		URL:     a.signedURL(path, variant, expires),
+		Expires: expires.UTC(),
+	})
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"errors"
+	"github.com/blang/pushr"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignedURL(t *testing.T) {
+	a, ts, cleanup := newTestServer(t)
+	defer cleanup()
+	a.tokens.readToken = "READ"
+	a.tokens.writeToken = "WRITE"
+
+	c := pushr.NewClient(ts.URL, "READ", "WRITE")
+	if err := c.Upload("test", "1.0.0", "test.zip", strings.NewReader("MAIN")); err != nil {
+		t.Fatalf("Upload failed: %s", err)
+	}
+	if err := c.UploadPlatform("test", "1.0.0", pushr.Platform{OS: "linux", Arch: "arm", Variant: "v7"}, "test.zip", strings.NewReader("ARM")); err != nil {
+		t.Fatalf("Upload failed: %s", err)
+	}
+	get := func(url string) (int, string) {
+		resp, err := http.Get(url)
+		if err != nil {
+			t.Fatalf("Request failed: %s", err)
+		}
+		defer resp.Body.Close()
+		b, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(b)
+	}
+
+	if code, _ := get(ts.URL + "/releases/test/1.0.0"); code != http.StatusUnauthorized {
+		t.Fatalf("Download without token returned %d", code)
+	}
+	link, err := c.SignedURL("test", "1.0.0", time.Minute)
+	if err != nil {
+		t.Fatalf("Could not create link: %s", err)
+	}
+	if d := time.Until(link.Expires); d <= 0 || d > time.Minute {
+		t.Errorf("Wrong expiry: %s", link.Expires)
+	}
+	if strings.Contains(link.URL, "READ") {
+		t.Errorf("Link contains token: %s", link.URL)
+	}
+	if code, body := get(link.URL); code != http.StatusOK || body != "MAIN" {
+		t.Errorf("Signed download returned %d: %s", code, body)
+	}
+
+	artifact, err := c.SignedPlatformURL("test", "1.0.0", pushr.Platform{OS: "linux", Arch: "arm", Variant: "v7"}, 0)
+	if err != nil {
+		t.Fatalf("Could not create artifact link: %s", err)
+	}
+	if code, body := get(artifact.URL); code != http.StatusOK || body != "ARM" {
+		t.Errorf("Signed artifact download returned %d: %s", code, body)
+	}
+	if code, _ := get(strings.Replace(artifact.URL, "variant=v7", "variant=v6", 1)); code != http.StatusForbidden {
+		t.Errorf("Link with changed variant returned %d", code)
+	}
+	if code, _ := get(strings.Replace(link.URL, "1.0.0", "1.0.1", 1)); code != http.StatusForbidden {
+		t.Errorf("Link with changed path returned %d", code)
+	}
+
+	expired := a.signedURL("/releases/test/1.0.0", "", time.Now().Add(-time.Second))
+	if code, _ := get(ts.URL + expired); code != http.StatusForbidden {
+		t.Errorf("Expired link returned %d", code)
+	}
+	tampered := a.signedURL("/releases/test/1.0.0", "", time.Now().Add(time.Minute))
+	tampered = strings.Replace(tampered, "expires=", "expires=1", 1)
+	if code, _ := get(ts.URL + tampered); code != http.StatusForbidden {
+		t.Errorf("Link with changed expiry returned %d", code)
+	}
+
+	if _, err := c.SignedURL("test", "1.0.0", 30*24*time.Hour); !errors.Is(err, pushr.ErrBadRequest) {
+		t.Errorf("Expected bad request for too long expiry, got %v", err)
+	}
+	if _, err := c.SignedURL("test", "2.0.0", 0); !errors.Is(err, pushr.ErrNotFound) {
+		t.Errorf("Expected not found for missing version, got %v", err)
+	}
+	if _, err := pushr.NewClient(ts.URL, "", "").SignedURL("test", "1.0.0", 0); !errors.Is(err, pushr.ErrUnauthorized) {
+		t.Errorf("Expected unauthorized without token, got %v", err)
+	}
+}
+
+func TestLoadURLKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pushrtest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, ".urlkey")
+	key, err := loadURLKey(path)
+	if err != nil || len(key) != 32 {
+		t.Fatalf("Could not generate key: %v", err)
+	}
+	loaded, err := loadURLKey(path)
+	if err != nil || string(loaded) != string(key) {
+		t.Errorf("Key not persisted: %v", err)
+	}
+	ioutil.WriteFile(path, []byte("invalid"), 0600)
+	if _, err := loadURLKey(path); err == nil {
+		t.Error("Invalid key accepted")
+	}
+}
+
+func TestQueryTokens(t *testing.T) {
+	a, ts, cleanup := newTestServer(t)
+	defer cleanup()
+	a.tokens.readToken = "READ"
+	a.tokens.writeToken = "WRITE"
+
+	c := pushr.NewClient(ts.URL, "READ", "WRITE")
+	if err := c.Upload("test", "1.0.0", "test.zip", strings.NewReader("MAIN")); err != nil {
+		t.Fatalf("Upload failed: %s", err)
+	}
+
+	// The latest download redirect replaces the token by a signed link
+	noRedirect := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := noRedirect.Get(ts.URL + "/releases/test/latest/download?token=READ&channel=stable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	location := resp.Header.Get("Location")
+	if resp.StatusCode != http.StatusFound || strings.Contains(location, "READ") || !strings.Contains(location, "signature=") {
+		t.Fatalf("Wrong redirect %d to %s", resp.StatusCode, location)
+	}
+	resp, err = http.Get(ts.URL + location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(b) != "MAIN" {
+		t.Errorf("Redirected download returned %d: %s", resp.StatusCode, b)
+	}
+
+	// Signed links of platform downloads point to the artifact
+	if err := c.UploadPlatform("test", "1.0.0", pushr.Platform{OS: "linux", Arch: "amd64"}, "test.zip", strings.NewReader("LINUX")); err != nil {
+		t.Fatalf("Upload failed: %s", err)
+	}
+	resp, err = http.Get(ts.URL + "/releases/test/latest/download?token=READ&os=linux&arch=amd64")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(b) != "LINUX" || strings.Contains(resp.Request.URL.String(), "READ") {
+		t.Errorf("Redirected platform download from %s returned %d: %s", resp.Request.URL, resp.StatusCode, b)
+	}
+
+	a.queryTokens = false
+	if resp, err := http.Get(ts.URL + "/releases/test?token=READ"); err != nil {
+		t.Fatal(err)
+	} else if resp.Body.Close(); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Query token accepted while disabled: %d", resp.StatusCode)
+	}
+	if _, err := c.Release("test"); err != nil {
+		t.Errorf("Header token denied: %s", err)
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/blang/pushr"
+	"github.com/blang/semver"
+	"github.com/gorilla/mux"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+const statsFilename = "stats.json"
+
+// Interval in which changed download statistics are saved
+const statsSaveInterval = time.Minute
+
+// downloadStats counts downloads by release and version.
+// The counters are saved to the storage periodically and on shutdown, not on every download.
+type downloadStats struct {
+	sync.Mutex
+	storage  Storage // Not persisted if nil
+	releases map[string]map[string]*pushr.DownloadStats
+	dirty    bool
+}
+
+func newDownloadStats(storage Storage) *downloadStats {
+	return &downloadStats{
+		storage:  storage,
+		releases: make(map[string]map[string]*pushr.DownloadStats),
+	}
+}
+
+// loadDownloadStats reads the statistics from the storage, a missing file starts with empty statistics.
+func loadDownloadStats(storage Storage) (*downloadStats, error) {
+	s := newDownloadStats(storage)
+	f, err := storage.Get(statsFilename)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if err := json.NewDecoder(f).Decode(&s.releases); err != nil {
+		return nil, fmt.Errorf("Could not read download statistics: %s", err)
+	}
+	return s, nil
+}
+
+// record counts a download at now. Partial downloads are range requests, e.g. resumed downloads,
+// only full downloads are counted per channel and day.
+func (s *downloadStats) record(release string, version string, channel string, partial bool, now time.Time) {
+	s.Lock()
+	defer s.Unlock()
+	versions, found := s.releases[release]
+	if !found {
+		versions = make(map[string]*pushr.DownloadStats)
+		s.releases[release] = versions
+	}
+	stats, found := versions[version]
+	if !found {
+		stats = &pushr.DownloadStats{}
+		versions[version] = stats
+	}
+	s.dirty = true
+	if partial {
+		stats.Partial++
+		return
+	}
+	stats.Full++
+	if channel != "" {
+		if stats.Channels == nil {
+			stats.Channels = make(map[string]int64)
+		}
+		stats.Channels[channel]++
+	}
+	if stats.Days == nil {
+		stats.Days = make(map[string]int64)
+	}
+	stats.Days[now.UTC().Format("2006-01-02")]++
+}
+
+// version returns a copy of the statistics of a version, zero if it was never downloaded.
+func (s *downloadStats) version(release string, version string) *pushr.DownloadStats {
+	s.Lock()
+	defer s.Unlock()
+	stats := &pushr.DownloadStats{}
+	if v, found := s.releases[release][version]; found {
+		addStats(stats, v)
+	}
+	return stats
+}
+
+// release returns the statistics of all versions of release and their sum.
+func (s *downloadStats) release(release string) *pushr.ReleaseStats {
+	s.Lock()
+	defer s.Unlock()
+	stats := &pushr.ReleaseStats{Versions: make(map[string]*pushr.DownloadStats)}
+	for versionStr, v := range s.releases[release] {
+		version := &pushr.DownloadStats{}
+		addStats(version, v)
+		stats.Versions[versionStr] = version
+		addStats(&stats.DownloadStats, v)
+	}
+	return stats
+}
+
+// addStats adds the counters of src to dst.
+func addStats(dst *pushr.DownloadStats, src *pushr.DownloadStats) {
+	dst.Full += src.Full
+	dst.Partial += src.Partial
+	for channel, n := range src.Channels {
+		if dst.Channels == nil {
+			dst.Channels = make(map[string]int64)
+		}
+		dst.Channels[channel] += n
+	}
+	for day, n := range src.Days {
+		if dst.Days == nil {
+			dst.Days = make(map[string]int64)
+		}
+		dst.Days[day] += n
+	}
+}
+
+// save writes the statistics to the storage if they changed since the last save.
+func (s *downloadStats) save() error {
+	s.Lock()
+	defer s.Unlock()
+	if !s.dirty || s.storage == nil {
+		return nil
+	}
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(s.releases); err != nil {
+		return err
+	}
+	if _, err := s.storage.Put(statsFilename, &buf); err != nil {
+		return err
+	}
+	s.dirty = false
+	return nil
+}
+
+// knownChannel reports whether downloads of version resolved from channel are counted for the channel:
+// the channel is stable, was promoted to or is the prerelease identifier of the version.
+// Other channel parameters resolve as well, but must not grow the statistics.
+func (a *RestAPI) knownChannel(name string, versionStr string, channel string) bool {
+	if channel == "stable" {
+		return true
+	}
+	if !validIdentifier(channel) {
+		return false
+	}
+	if _, found := a.ds.Channel(name, channel); found {
+		return true
+	}
+	v, err := semver.New(versionStr)
+	return err == nil && len(v.Pre) > 0 && v.Pre[0].String() == channel
+}
+
+// signChannel returns the channelsig parameter set by the latest download redirect,
+// attributing a download of version to channel.
+func (a *RestAPI) signChannel(name string, versionStr string, channel string) string {
+	mac := hmac.New(sha256.New, a.urlKey)
+	mac.Write([]byte("channel\n" + name + "\n" + versionStr + "\n" + channel))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// downloadChannel returns the channel a download was resolved from, empty unless the request
+// was redirected by the latest download endpoint.
+func (a *RestAPI) downloadChannel(r *http.Request, name string, versionStr string) string {
+	query := r.URL.Query()
+	signature, err := hex.DecodeString(query.Get("channelsig"))
+	if err != nil || len(signature) == 0 {
+		return ""
+	}
+	expected, _ := hex.DecodeString(a.signChannel(name, versionStr, query.Get("channel")))
+	if !hmac.Equal(signature, expected) {
+		return ""
+	}
+	return query.Get("channel")
+}
+
+func (a *RestAPI) handleReleaseStats(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	a.ds.RLock()
+	_, found := a.ds.releases[name]
+	a.ds.RUnlock()
+	if !found {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(a.stats.release(name))
+}
+
+func (a *RestAPI) handleVersionStats(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	// Statistics of deleted versions stay available
+	stats := a.stats.version(vars["name"], vars["version"])
+	if _, found := a.ds.Version(vars["name"], vars["version"]); !found && stats.Full == 0 && stats.Partial == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(stats)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"github.com/blang/pushr"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDownloadStats(t *testing.T) {
+	a, ts, cleanup := newTestServer(t)
+	defer cleanup()
+
+	c := pushr.NewClient(ts.URL, "", "")
+	for _, v := range []string{"1.0.0", "2.0.0"} {
+		if err := c.Upload("test", v, "test.zip", strings.NewReader("TESTOUTPUT")); err != nil {
+			t.Fatalf("Upload failed: %s", err)
+		}
+	}
+	if err := c.Promote("test", "stable", "1.0.0"); err != nil {
+		t.Fatalf("Promote failed: %s", err)
+	}
+	get := func(path string, header map[string]string) {
+		req, _ := http.NewRequest("GET", ts.URL+path, nil)
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Request failed: %s", err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+	get("/releases/test/1.0.0", nil)
+	get("/releases/test/latest/download?channel=stable", nil)
+	get("/releases/test/1.0.0", map[string]string{"Range": "bytes=5-"})
+	get("/releases/test/1.0.0", map[string]string{"Accept": "application/json"})
+	get("/releases/test/2.0.0", nil)
+	// Channels are only counted for downloads resolved by the latest download endpoint
+	get("/releases/test/2.0.0?channel=junk", nil)
+	get("/releases/test/latest/download?channel=junk", nil)
+	get("/releases/test/2.0.0?channel=stable&channelsig=00", nil)
+
+	stats, err := c.VersionStats("test", "1.0.0")
+	if err != nil {
+		t.Fatalf("Could not get version stats: %s", err)
+	}
+	today := time.Now().UTC().Format("2006-01-02")
+	if stats.Full != 2 || stats.Partial != 1 || stats.Channels["stable"] != 1 || stats.Days[today] != 2 {
+		t.Errorf("Wrong version stats: %+v", stats)
+	}
+	release, err := c.Stats("test")
+	if err != nil {
+		t.Fatalf("Could not get release stats: %s", err)
+	}
+	if release.Full != 6 || release.Partial != 1 || release.Days[today] != 6 || release.Versions["2.0.0"].Full != 4 || len(release.Channels) != 1 {
+		t.Errorf("Wrong release stats: %+v", release)
+	}
+	if _, err := c.Stats("unknown"); !errors.Is(err, pushr.ErrNotFound) {
+		t.Errorf("Expected not found for unknown release, got %v", err)
+	}
+	if _, err := c.VersionStats("test", "3.0.0"); !errors.Is(err, pushr.ErrNotFound) {
+		t.Errorf("Expected not found for unknown version, got %v", err)
+	}
+
+	// Counters survive a restart
+	a.stats.storage = a.ds.storage
+	if err := a.stats.save(); err != nil {
+		t.Fatalf("Could not save stats: %s", err)
+	}
+	loaded, err := loadDownloadStats(a.ds.storage)
+	if err != nil {
+		t.Fatalf("Could not load stats: %s", err)
+	}
+	if v := loaded.version("test", "1.0.0"); v.Full != 2 || v.Partial != 1 || v.Channels["stable"] != 1 {
+		t.Errorf("Wrong loaded stats: %+v", v)
+	}
+	if err := c.Promote("test", "stable", "2.0.0"); err != nil {
+		t.Fatalf("Promote failed: %s", err)
+	}
+	if err := c.Delete("test", "1.0.0"); err != nil {
+		t.Fatalf("Delete failed: %s", err)
+	}
+	if stats, err := c.VersionStats("test", "1.0.0"); err != nil || stats.Full != 2 {
+		t.Errorf("Stats of deleted version lost: %v %v", stats, err)
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Storage stores the release files and the metadata index.
+// Names may contain slashes, nesting files like paths. List only returns the files at the top level.
+// Get and Stat return an error matching os.ErrNotExist if there is no such file.
+type Storage interface {
+	// Put stores the content of r under name, replacing an existing file atomically.
+	Put(name string, r io.Reader) (int64, error)
+	Get(name string) (File, error)
+	Stat(name string) (*FileInfo, error)
+	Delete(name string) error
+	List() ([]*FileInfo, error)
+}
+
+// fileMover is implemented by storages which can take over a local file without copying it.
+type fileMover interface {
+	// Move atomically moves the local file at path into the storage under name.
+	Move(name string, path string) error
+}
+
+// File is a stored file opened for reading.
+type File interface {
+	io.ReadSeeker
+	io.Closer
+}
+
+type FileInfo struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+}
+
+// fsStorage stores files inside a local directory, nested names are stored in subdirectories.
+// Hidden files are reserved for temporary files and not listed.
+type fsStorage struct {
+	dir string
+}
+
+func newFSStorage(dir string) (*fsStorage, error) {
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return nil, &os.PathError{Op: "open", Path: dir, Err: os.ErrInvalid}
+	}
+	return &fsStorage{dir: filepath.Clean(dir)}, nil
+}
+
+// path returns the local path of name, which never leaves the storage directory.
+func (s *fsStorage) path(name string) string {
+	return filepath.Join(s.dir, filepath.FromSlash(path.Clean("/"+name)))
+}
+
+func (s *fsStorage) Put(name string, r io.Reader) (int64, error) {
+	dir := filepath.Dir(s.path(name))
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return 0, err
+	}
+	tmp, err := ioutil.TempFile(dir, "."+filepath.Base(name))
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+
+	written, err := io.Copy(tmp, r)
+	if err != nil {
+		tmp.Close()
+		return written, err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return written, err
+	}
+	if err := tmp.Close(); err != nil {
+		return written, err
+	}
+	if err := os.Chmod(tmp.Name(), 0600); err != nil {
+		return written, err
+	}
+	if err := os.Rename(tmp.Name(), s.path(name)); err != nil {
+		return written, err
+	}
+	return written, s.syncDir(dir)
+}
+
+func (s *fsStorage) Move(name string, local string) error {
+	dir := filepath.Dir(s.path(name))
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	if err := os.Chmod(local, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(local, s.path(name)); err != nil {
+		return err
+	}
+	return s.syncDir(dir)
+}
+
+// syncDir makes renames inside a directory of the storage durable.
+func (s *fsStorage) syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+func (s *fsStorage) Get(name string) (File, error) {
+	return os.Open(s.path(name))
+}
+
+func (s *fsStorage) Stat(name string) (*FileInfo, error) {
+	fi, err := os.Stat(s.path(name))
+	if err != nil {
+		return nil, err
+	}
+	return &FileInfo{Name: name, Size: fi.Size(), ModTime: fi.ModTime()}, nil
+}
+
+// Delete removes the file of name and the directories left empty by it.
+func (s *fsStorage) Delete(name string) error {
+	p := s.path(name)
+	if err := os.Remove(p); err != nil {
+		return err
+	}
+	for dir := filepath.Dir(p); dir != s.dir && strings.HasPrefix(dir, s.dir); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+	return nil
+}
+
+func (s *fsStorage) List() ([]*FileInfo, error) {
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]*FileInfo, 0, len(files))
+	for _, fi := range files {
+		if fi.IsDir() || strings.HasPrefix(fi.Name(), ".") {
+			continue
+		}
+		infos = append(infos, &FileInfo{Name: fi.Name(), Size: fi.Size(), ModTime: fi.ModTime()})
+	}
+	return infos, nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// testStorage runs the behaviour every Storage implementation has to provide.
+func testStorage(t *testing.T, st Storage) {
+	written, err := st.Put("test-1.0.0.zip", strings.NewReader("TESTOUTPUT"))
+	if err != nil {
+		t.Fatalf("Could not put file: %s", err)
+	}
+	if written != 10 {
+		t.Errorf("Put wrote %d bytes, expected 10", written)
+	}
+	if _, err := st.Put("test-1.0.1.zip", strings.NewReader("OTHER")); err != nil {
+		t.Fatalf("Could not put file: %s", err)
+	}
+
+	// Replace existing file
+	if _, err := st.Put("test-1.0.1.zip", strings.NewReader("REPLACED")); err != nil {
+		t.Fatalf("Could not replace file: %s", err)
+	}
+
+	fi, err := st.Stat("test-1.0.0.zip")
+	if err != nil {
+		t.Fatalf("Could not stat file: %s", err)
+	}
+	if fi.Name != "test-1.0.0.zip" || fi.Size != 10 {
+		t.Errorf("Wrong file info: %v", fi)
+	}
+
+	f, err := st.Get("test-1.0.1.zip")
+	if err != nil {
+		t.Fatalf("Could not get file: %s", err)
+	}
+	b, err := ioutil.ReadAll(f)
+	if err != nil || string(b) != "REPLACED" {
+		t.Errorf("Read wrong content %q: %v", string(b), err)
+	}
+	if _, err := f.Seek(2, io.SeekStart); err != nil {
+		t.Fatalf("Could not seek: %s", err)
+	}
+	b, err = ioutil.ReadAll(f)
+	if err != nil || string(b) != "PLACED" {
+		t.Errorf("Read wrong content after seek %q: %v", string(b), err)
+	}
+	if size, err := f.Seek(0, io.SeekEnd); err != nil || size != 8 {
+		t.Errorf("Seek to end returned %d: %v", size, err)
+	}
+	f.Close()
+
+	// Nested files are not listed and do not clash with flat ones
+	if _, err := st.Put("test/1.0.0/test-1.0.0.zip", strings.NewReader("NESTED")); err != nil {
+		t.Fatalf("Could not put nested file: %s", err)
+	}
+	if f, err := st.Get("test/1.0.0/test-1.0.0.zip"); err != nil {
+		t.Errorf("Could not get nested file: %s", err)
+	} else {
+		b, _ := ioutil.ReadAll(f)
+		f.Close()
+		if string(b) != "NESTED" {
+			t.Errorf("Read wrong nested content %q", string(b))
+		}
+	}
+
+	infos, err := st.List()
+	if err != nil {
+		t.Fatalf("Could not list files: %s", err)
+	}
+	var names []string
+	for _, fi := range infos {
+		names = append(names, fi.Name)
+	}
+	sort.Strings(names)
+	if strings.Join(names, ",") != "test-1.0.0.zip,test-1.0.1.zip" {
+		t.Errorf("Wrong files listed: %v", names)
+	}
+
+	if err := st.Delete("test-1.0.0.zip"); err != nil {
+		t.Fatalf("Could not delete file: %s", err)
+	}
+	if _, err := st.Get("test-1.0.0.zip"); !os.IsNotExist(err) {
+		t.Errorf("Expected not exist error for deleted file, got %v", err)
+	}
+	if _, err := st.Stat("test-1.0.0.zip"); !os.IsNotExist(err) {
+		t.Errorf("Expected not exist error for deleted file, got %v", err)
+	}
+	if err := st.Delete("test/1.0.0/test-1.0.0.zip"); err != nil {
+		t.Fatalf("Could not delete nested file: %s", err)
+	}
+	if _, err := st.Stat("test/1.0.0/test-1.0.0.zip"); !os.IsNotExist(err) {
+		t.Errorf("Expected not exist error for deleted nested file, got %v", err)
+	}
+}
+
+func TestFSStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pushrtest")
+	if err != nil {
+		t.Fatalf("Could not create test dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	st, err := newFSStorage(dir)
+	if err != nil {
+		t.Fatalf("Could not create storage: %s", err)
+	}
+	testStorage(t, st)
+	if _, err := os.Stat(filepath.Join(dir, "test")); !os.IsNotExist(err) {
+		t.Errorf("Empty directory of deleted nested file left: %v", err)
+	}
+	if _, err := st.Put("../outside.zip", strings.NewReader("ESCAPED")); err != nil {
+		t.Fatalf("Could not put file: %s", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "outside.zip")); err != nil {
+		t.Errorf("File name escaped the storage directory: %v", err)
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"github.com/blang/pushr"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCert issues a certificate for name, self-signed if parent is nil.
+func testCert(t *testing.T, name string, serial int64, parent *tls.Certificate) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  parent == nil,
+	}
+	issuer, signer := template, interface{}(key)
+	if parent != nil {
+		issuer, signer = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, issuer, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _ := x509.ParseCertificate(der)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func writeCert(t *testing.T, cert tls.Certificate, certFile string, keyFile string) {
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key}), 0600)
+}
+
+func TestTLS(t *testing.T) {
+	a, _, cleanup := newTestServer(t)
+	defer cleanup()
+	dir, err := ioutil.TempDir("", "pushrtest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := testCert(t, "ca", 1, nil)
+	certFile, keyFile, caFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"), filepath.Join(dir, "ca.pem")
+	writeCert(t, testCert(t, "server", 2, &ca), certFile, keyFile)
+	ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Certificate[0]}), 0600)
+
+	certs, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("Could not load certificate: %s", err)
+	}
+	config, err := newTLSConfig(certs, caFile)
+	if err != nil {
+		t.Fatalf("Could not create TLS config: %s", err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: a, TLSConfig: config}
+	go srv.ServeTLS(ln, "", "")
+	defer srv.Close()
+	url := "https://" + ln.Addr().String()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Leaf)
+	if err := pushr.NewClient(url, "", "").Upload("test", "1.0.0", "test.zip", strings.NewReader("TEST")); err == nil {
+		t.Error("Client without CA accepted server certificate")
+	}
+	c := pushr.NewClient(url, "", "", pushr.WithRootCAs(roots))
+	if err := c.Upload("test", "1.0.0", "test.zip", strings.NewReader("TEST")); err != nil {
+		t.Fatalf("Upload over TLS failed: %s", err)
+	}
+
+	// Client certificates authenticate as the token named by their common name
+	if _, err := a.tokens.create(&pushr.Token{Name: "deploy", Scopes: []string{pushr.ScopeRead}, Releases: []string{"test"}}); err != nil {
+		t.Fatal(err)
+	}
+	deploy := pushr.NewClient(url, "", "", pushr.WithRootCAs(roots), pushr.WithClientCertificate(testCert(t, "deploy", 3, &ca)))
+	if _, err := deploy.Release("test"); err != nil {
+		t.Errorf("Read with client certificate failed: %s", err)
+	}
+	if err := deploy.Upload("test", "2.0.0", "test.zip", strings.NewReader("TEST")); !errors.Is(err, pushr.ErrForbidden) {
+		t.Errorf("Upload without scope: expected forbidden, got %v", err)
+	}
+	if _, err := c.Release("test"); !errors.Is(err, pushr.ErrUnauthorized) {
+		t.Errorf("Read without certificate: expected unauthorized, got %v", err)
+	}
+	unknown := pushr.NewClient(url, "", "", pushr.WithRootCAs(roots), pushr.WithClientCertificate(testCert(t, "unknown", 4, &ca)))
+	if _, err := unknown.Release("test"); !errors.Is(err, pushr.ErrForbidden) {
+		t.Errorf("Read with certificate of unknown name: expected forbidden, got %v", err)
+	}
+	untrusted := testCert(t, "untrusted", 5, nil)
+	if _, err := pushr.NewClient(url, "", "", pushr.WithRootCAs(roots), pushr.WithClientCertificate(testCert(t, "deploy", 6, &untrusted))).Release("test"); err == nil {
+		t.Error("Certificate of other CA accepted")
+	}
+
+	// Reload replaces the certificate for new connections
+	writeCert(t, testCert(t, "server", 7, &ca), certFile, keyFile)
+	if err := certs.reload(); err != nil {
+		t.Fatalf("Reload failed: %s", err)
+	}
+	conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{RootCAs: roots})
+	if err != nil {
+		t.Fatalf("Could not connect: %s", err)
+	}
+	if serial := conn.ConnectionState().PeerCertificates[0].SerialNumber.Int64(); serial != 7 {
+		t.Errorf("Certificate not reloaded, serial %d", serial)
+	}
+	conn.Close()
+	ioutil.WriteFile(certFile, []byte("invalid"), 0600)
+	if err := certs.reload(); err == nil {
+		t.Error("Reload of invalid certificate succeeded")
+	}
+	if cert, _ := certs.GetCertificate(nil); cert.Leaf.SerialNumber.Int64() != 7 {
+		t.Error("Invalid certificate replaced the current one")
+	}
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/blang/pushr"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	errTokenExists   = errors.New("Token already exists")
+	errTokenNotFound = errors.New("Token not found")
+)
+
+var validScopes = map[string]bool{
+	pushr.ScopeRead:   true,
+	pushr.ScopeWrite:  true,
+	pushr.ScopeDelete: true,
+	pushr.ScopeAdmin:  true,
+}
+
+// storedToken is a token as persisted, the secret is only kept as SHA-256 hash.
+// Secrets are random, so a plain hash is sufficient.
+type storedToken struct {
+	pushr.Token
+	Hash string `json:"hash"`
+}
+
+// allReleases is the release checked by endpoints affecting every release, e.g. token management.
+// Only tokens without release restriction grant access to it. It is no valid release name.
+const allReleases = "/"
+
+// allows reports whether the token grants scope on release, ignoring the expiry.
+// An empty release matches if the token grants scope on any release.
+func (t *storedToken) allows(scope string, release string) bool {
+	found := false
+	for _, s := range t.Scopes {
+		if s == scope {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return false
+	}
+	if release == allReleases {
+		return len(t.Releases) == 0
+	}
+	if release == "" || len(t.Releases) == 0 {
+		return true
+	}
+	for _, pattern := range t.Releases {
+		if matched, _ := path.Match(pattern, release); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// tokenStore holds the API tokens, persisted to a JSON file if path is not empty.
+// The legacy read and write tokens of the command line are accepted in addition:
+// the read token grants read access, the write token all scopes.
+type tokenStore struct {
+	sync.RWMutex
+	path       string
+	tokens     map[string]*storedToken // By name
+	managed    bool                    // Set once the token file exists or a token was created
+	readToken  string
+	writeToken string
+}
+
+func hashToken(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// loadTokenStore reads the token file at path, a missing file is an empty store.
+func loadTokenStore(path string, readToken string, writeToken string) (*tokenStore, error) {
+	s := &tokenStore{
+		path:       path,
+		tokens:     make(map[string]*storedToken),
+		readToken:  readToken,
+		writeToken: writeToken,
+	}
+	if path == "" {
+		return s, nil
+	}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.managed = true
+	var tokens []*storedToken
+	if err := json.Unmarshal(b, &tokens); err != nil {
+		return nil, fmt.Errorf("Could not read token file %s: %s", path, err)
+	}
+	for _, t := range tokens {
+		s.tokens[t.Name] = t
+	}
+	return s, nil
+}
+
+// open reports whether scope is granted without token.
+// This is the case as long as no token was ever created and the legacy token of the scope is not set,
+// keeping the behavior of servers started without tokens. Revoking all tokens does not open the server.
+func (s *tokenStore) open(scope string) bool {
+	s.RLock()
+	defer s.RUnlock()
+	if s.managed {
+		return false
+	}
+	if scope == pushr.ScopeRead {
+		return s.readToken == ""
+	}
+	return s.writeToken == ""
+}
+
+var (
+	errUnauthorized = errors.New("Unauthorized")
+	errForbidden    = errors.New("Forbidden")
+)
+
+// check returns nil if secret grants scope on release, errUnauthorized if the secret is unknown
+// and errForbidden if the token lacks the scope or the release.
+func (s *tokenStore) check(secret string, scope string, release string) error {
+	if s.open(scope) {
+		return nil
+	}
+	if secret == "" {
+		return errUnauthorized
+	}
+	if s.writeToken != "" && subtle.ConstantTimeCompare([]byte(secret), []byte(s.writeToken)) == 1 {
+		return nil
+	}
+	if s.readToken != "" && subtle.ConstantTimeCompare([]byte(secret), []byte(s.readToken)) == 1 {
+		if scope == pushr.ScopeRead {
+			return nil
+		}
+		return errForbidden
+	}
+	hash := hashToken(secret)
+	s.RLock()
+	defer s.RUnlock()
+	for _, t := range s.tokens {
+		if subtle.ConstantTimeCompare([]byte(hash), []byte(t.Hash)) == 1 {
+			if t.Expires != nil && !time.Now().Before(*t.Expires) {
+				return errUnauthorized
+			}
+			if !t.allows(scope, release) {
+				return errForbidden
+			}
+			return nil
+		}
+	}
+	return errUnauthorized
+}
+
+// identity returns the name of the token with the given secret for logging, never the secret itself.
+func (s *tokenStore) identity(secret string) string {
+	switch {
+	case secret == "":
+		return "anonymous"
+	case s.writeToken != "" && subtle.ConstantTimeCompare([]byte(secret), []byte(s.writeToken)) == 1:
+		return "writetoken"
+	case s.readToken != "" && subtle.ConstantTimeCompare([]byte(secret), []byte(s.readToken)) == 1:
+		return "readtoken"
+	}
+	hash := hashToken(secret)
+	s.RLock()
+	defer s.RUnlock()
+	for _, t := range s.tokens {
+		if subtle.ConstantTimeCompare([]byte(hash), []byte(t.Hash)) == 1 {
+			return t.Name
+		}
+	}
+	return "unknown"
+}
+
+// checkName checks the permissions of the token with the given name, used for clients authenticated
+// by certificate with the token name as common name. Without token file, certificates grant read access only,
+// like the legacy read token.
+func (s *tokenStore) checkName(name string, scope string, release string) error {
+	s.RLock()
+	defer s.RUnlock()
+	t, found := s.tokens[name]
+	if !found {
+		if s.managed || scope != pushr.ScopeRead {
+			return errForbidden
+		}
+		return nil
+	}
+	if t.Expires != nil && !time.Now().Before(*t.Expires) {
+		return errUnauthorized
+	}
+	if !t.allows(scope, release) {
+		return errForbidden
+	}
+	return nil
+}
+
+// create adds a new token and returns it including the generated secret.
+func (s *tokenStore) create(t *pushr.Token) (*pushr.Token, error) {
+	if !validIdentifier(t.Name) {
+		return nil, fmt.Errorf("Invalid token name %q", t.Name)
+	}
+	if len(t.Scopes) == 0 {
+		return nil, errors.New("No scopes given")
+	}
+	for _, scope := range t.Scopes {
+		if !validScopes[scope] {
+			return nil, fmt.Errorf("Invalid scope %q", scope)
+		}
+	}
+	for _, pattern := range t.Releases {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("Invalid release pattern %q", pattern)
+		}
+	}
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	secret := hex.EncodeToString(b)
+
+	s.Lock()
+	defer s.Unlock()
+	if _, found := s.tokens[t.Name]; found {
+		return nil, errTokenExists
+	}
+	stored := &storedToken{Token: *t, Hash: hashToken(secret)}
+	stored.Secret = ""
+	stored.Created = time.Now().UTC()
+	s.tokens[t.Name] = stored
+	managed := s.managed
+	s.managed = true
+	if err := s.save(); err != nil {
+		delete(s.tokens, t.Name)
+		s.managed = managed
+		return nil, err
+	}
+	created := stored.Token
+	created.Secret = secret
+	return &created, nil
+}
+
+// revoke removes the token with the given name.
+func (s *tokenStore) revoke(name string) error {
+	s.Lock()
+	defer s.Unlock()
+	t, found := s.tokens[name]
+	if !found {
+		return errTokenNotFound
+	}
+	delete(s.tokens, name)
+	if err := s.save(); err != nil {
+		s.tokens[name] = t
+		return err
+	}
+	return nil
+}
+
+// list returns all tokens sorted by name, without hashes.
+func (s *tokenStore) list() []*pushr.Token {
+	s.RLock()
+	defer s.RUnlock()
+	tokens := make([]*pushr.Token, 0, len(s.tokens))
+	for _, t := range s.tokens {
+		token := t.Token
+		tokens = append(tokens, &token)
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].Name < tokens[j].Name })
+	return tokens
+}
+
+// save atomically writes the token file, readable by the owner only.
+// The caller must hold the write lock.
+func (s *tokenStore) save() error {
+	if s.path == "" {
+		return nil
+	}
+	tokens := make([]*storedToken, 0, len(s.tokens))
+	for _, t := range s.tokens {
+		tokens = append(tokens, t)
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].Name < tokens[j].Name })
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetIndent("", "\t")
+	if err := enc.Encode(tokens); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), "."+filepath.Base(s.path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(buf.Bytes()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
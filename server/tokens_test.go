@@ -0,0 +1,202 @@
+package main
+
+import (
+	"errors"
+	"github.com/blang/pushr"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTokenStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pushrtokens")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "tokens.json")
+
+	s, err := loadTokenStore(path, "", "")
+	if err != nil {
+		t.Fatalf("Could not load token store: %s", err)
+	}
+	if err := s.check("", pushr.ScopeAdmin, ""); err != nil {
+		t.Errorf("Empty store without legacy tokens not open: %v", err)
+	}
+
+	past := time.Now().Add(-time.Hour)
+	ci, err := s.create(&pushr.Token{Name: "ci", Scopes: []string{pushr.ScopeRead, pushr.ScopeWrite}, Releases: []string{"team-*"}})
+	if err != nil {
+		t.Fatalf("Could not create token: %s", err)
+	}
+	expired, err := s.create(&pushr.Token{Name: "expired", Scopes: []string{pushr.ScopeRead}, Expires: &past})
+	if err != nil {
+		t.Fatalf("Could not create token: %s", err)
+	}
+	if _, err := s.create(&pushr.Token{Name: "ci", Scopes: []string{pushr.ScopeRead}}); err != errTokenExists {
+		t.Errorf("Expected token exists error, got %v", err)
+	}
+	for _, invalid := range []*pushr.Token{
+		{Name: "", Scopes: []string{pushr.ScopeRead}},
+		{Name: "a/b", Scopes: []string{pushr.ScopeRead}},
+		{Name: "noscope"},
+		{Name: "badscope", Scopes: []string{"root"}},
+		{Name: "badpattern", Scopes: []string{pushr.ScopeRead}, Releases: []string{"["}},
+	} {
+		if _, err := s.create(invalid); err == nil {
+			t.Errorf("Invalid token %v created", invalid)
+		}
+	}
+
+	// Secrets are only stored hashed
+	b, _ := ioutil.ReadFile(path)
+	if strings.Contains(string(b), ci.Secret) || !strings.Contains(string(b), hashToken(ci.Secret)) {
+		t.Errorf("Token file does not contain the hashed secret only: %s", b)
+	}
+	if fi, _ := os.Stat(path); fi.Mode().Perm() != 0600 {
+		t.Errorf("Token file readable by others: %s", fi.Mode())
+	}
+
+	s, err = loadTokenStore(path, "", "")
+	if err != nil {
+		t.Fatalf("Could not reload token store: %s", err)
+	}
+	tests := []struct {
+		secret   string
+		scope    string
+		release  string
+		expected error
+	}{
+		{ci.Secret, pushr.ScopeRead, "team-a", nil},
+		{ci.Secret, pushr.ScopeWrite, "team-b", nil},
+		{ci.Secret, pushr.ScopeWrite, "", nil},
+		{ci.Secret, pushr.ScopeWrite, "other", errForbidden},
+		{ci.Secret, pushr.ScopeDelete, "team-a", errForbidden},
+		{ci.Secret, pushr.ScopeAdmin, "", errForbidden},
+		{expired.Secret, pushr.ScopeRead, "team-a", errUnauthorized},
+		{"unknown", pushr.ScopeRead, "team-a", errUnauthorized},
+		{"", pushr.ScopeRead, "team-a", errUnauthorized},
+	}
+	for _, test := range tests {
+		if err := s.check(test.secret, test.scope, test.release); err != test.expected {
+			t.Errorf("Check of %s on %q: expected %v, got %v", test.scope, test.release, test.expected, err)
+		}
+	}
+
+	if err := s.revoke("ci"); err != nil {
+		t.Fatalf("Could not revoke token: %s", err)
+	}
+	if err := s.check(ci.Secret, pushr.ScopeRead, "team-a"); err != errUnauthorized {
+		t.Errorf("Revoked token accepted: %v", err)
+	}
+	if err := s.revoke("ci"); err != errTokenNotFound {
+		t.Errorf("Expected token not found error, got %v", err)
+	}
+	if tokens := s.list(); len(tokens) != 1 || tokens[0].Name != "expired" || tokens[0].Secret != "" {
+		t.Errorf("Wrong token list: %v", tokens)
+	}
+}
+
+func TestLegacyTokens(t *testing.T) {
+	s, _ := loadTokenStore("", "", "WRITE")
+	if err := s.check("", pushr.ScopeRead, "test"); err != nil {
+		t.Errorf("Read access without read token not open: %v", err)
+	}
+	if err := s.check("", pushr.ScopeWrite, "test"); err != errUnauthorized {
+		t.Errorf("Write access without token: %v", err)
+	}
+
+	s, _ = loadTokenStore("", "READ", "WRITE")
+	for _, scope := range []string{pushr.ScopeRead, pushr.ScopeWrite, pushr.ScopeDelete, pushr.ScopeAdmin} {
+		if err := s.check("WRITE", scope, "test"); err != nil {
+			t.Errorf("Write token denied %s: %v", scope, err)
+		}
+	}
+	if err := s.check("READ", pushr.ScopeRead, "test"); err != nil {
+		t.Errorf("Read token denied read: %v", err)
+	}
+	if err := s.check("READ", pushr.ScopeWrite, "test"); err != errForbidden {
+		t.Errorf("Read token granted write: %v", err)
+	}
+
+	// Without token file, client certificates get read access only
+	if err := s.checkName("consumer", pushr.ScopeRead, "test"); err != nil {
+		t.Errorf("Certificate denied read: %v", err)
+	}
+	for _, scope := range []string{pushr.ScopeWrite, pushr.ScopeDelete, pushr.ScopeAdmin} {
+		if err := s.checkName("consumer", scope, "test"); err != errForbidden {
+			t.Errorf("Certificate granted %s: %v", scope, err)
+		}
+	}
+}
+
+func TestTokenEndpoints(t *testing.T) {
+	a, ts, cleanup := newTestServer(t)
+	defer cleanup()
+	a.tokens.writeToken = "ADMIN"
+
+	admin := pushr.NewClient(ts.URL, "", "ADMIN")
+	token, err := admin.CreateToken(&pushr.Token{Name: "team", Scopes: []string{pushr.ScopeRead, pushr.ScopeWrite}, Releases: []string{"team-*"}})
+	if err != nil || token.Secret == "" {
+		t.Fatalf("Could not create token: %v", err)
+	}
+	if _, err := admin.CreateToken(&pushr.Token{Name: "team", Scopes: []string{pushr.ScopeRead}}); !errors.Is(err, pushr.ErrConflict) {
+		t.Errorf("Expected conflict for duplicate token, got %v", err)
+	}
+
+	team := pushr.NewClient(ts.URL, token.Secret, token.Secret)
+	if err := team.Upload("team-a", "1.0.0", "test.zip", strings.NewReader("TEST")); err != nil {
+		t.Errorf("Upload with scoped token failed: %s", err)
+	}
+	if _, err := team.Release("team-a"); err != nil {
+		t.Errorf("Read with scoped token failed: %s", err)
+	}
+	if err := team.Upload("other", "1.0.0", "test.zip", strings.NewReader("TEST")); !errors.Is(err, pushr.ErrForbidden) {
+		t.Errorf("Upload to other release: expected forbidden, got %v", err)
+	}
+	if err := team.Delete("team-a", "1.0.0"); !errors.Is(err, pushr.ErrForbidden) {
+		t.Errorf("Delete without scope: expected forbidden, got %v", err)
+	}
+	if _, err := team.Tokens(); !errors.Is(err, pushr.ErrForbidden) {
+		t.Errorf("Token list without admin scope: expected forbidden, got %v", err)
+	}
+	// Admins of some releases must not manage the tokens of all releases
+	teamAdmin, err := admin.CreateToken(&pushr.Token{Name: "teamadmin", Scopes: []string{pushr.ScopeAdmin}, Releases: []string{"team-*"}})
+	if err != nil {
+		t.Fatalf("Could not create token: %v", err)
+	}
+	teamAdminClient := pushr.NewClient(ts.URL, teamAdmin.Secret, teamAdmin.Secret)
+	if _, err := teamAdminClient.CreateToken(&pushr.Token{Name: "escalated", Scopes: []string{pushr.ScopeAdmin, pushr.ScopeDelete}}); !errors.Is(err, pushr.ErrForbidden) {
+		t.Errorf("Token creation by release-scoped admin: expected forbidden, got %v", err)
+	}
+	if _, err := teamAdminClient.Tokens(); !errors.Is(err, pushr.ErrForbidden) {
+		t.Errorf("Token list by release-scoped admin: expected forbidden, got %v", err)
+	}
+	if err := teamAdminClient.RevokeToken("team"); !errors.Is(err, pushr.ErrForbidden) {
+		t.Errorf("Token revocation by release-scoped admin: expected forbidden, got %v", err)
+	}
+	if err := admin.RevokeToken("teamadmin"); err != nil {
+		t.Fatalf("Could not revoke token: %s", err)
+	}
+
+	if _, err := pushr.NewClient(ts.URL, "", "").Release("team-a"); !errors.Is(err, pushr.ErrUnauthorized) {
+		t.Errorf("Read without token: expected unauthorized, got %v", err)
+	}
+
+	tokens, err := admin.Tokens()
+	if err != nil || len(tokens) != 1 || tokens[0].Name != "team" || tokens[0].Secret != "" {
+		t.Fatalf("Wrong token list: %v (%v)", tokens, err)
+	}
+	if err := admin.RevokeToken("team"); err != nil {
+		t.Fatalf("Could not revoke token: %s", err)
+	}
+	if err := admin.RevokeToken("team"); !errors.Is(err, pushr.ErrNotFound) {
+		t.Errorf("Expected not found for revoked token, got %v", err)
+	}
+	if _, err := team.Release("team-a"); !errors.Is(err, pushr.ErrUnauthorized) {
+		t.Errorf("Read with revoked token: expected unauthorized, got %v", err)
+	}
+}
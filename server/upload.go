@@ -0,0 +1,166 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"github.com/blang/pushr"
+	"hash"
+	"io/ioutil"
+	"log"
+	"mime"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// stagedUpload is an upload written to the staging directory.
+// It is moved into the storage only after it has been synced and verified,
+// so an interrupted upload never shows up as a stored file.
+type stagedUpload struct {
+	file   *os.File
+	size   int64
+	sha256 hash.Hash
+	sha512 hash.Hash
+
+	signature string // Detached signature sent by the client, stored unverified
+}
+
+// verifyError is returned if an upload does not match the announced size or digest.
+type verifyError struct {
+	msg string
+}
+
+func (e *verifyError) Error() string {
+	return e.msg
+}
+
+func newStagedUpload(stagingDir string, withSHA512 bool) (*stagedUpload, error) {
+	f, err := ioutil.TempFile(stagingDir, "upload-")
+	if err != nil {
+		return nil, err
+	}
+	u := &stagedUpload{
+		file:   f,
+		sha256: sha256.New(),
+	}
+	if withSHA512 {
+		u.sha512 = sha512.New()
+	}
+	return u, nil
+}
+
+func (u *stagedUpload) Write(p []byte) (int, error) {
+	n, err := u.file.Write(p)
+	u.size += int64(n)
+	u.sha256.Write(p[:n])
+	if u.sha512 != nil {
+		u.sha512.Write(p[:n])
+	}
+	return n, err
+}
+
+// finish syncs the staged file and verifies it against the expected size (if not negative)
+// and the checksums of a Digest header (if not empty).
+func (u *stagedUpload) finish(expectedSize int64, digest string) error {
+	if err := u.file.Sync(); err != nil {
+		return err
+	}
+	if u.size == 0 {
+		return &verifyError{"Empty upload"}
+	}
+	if expectedSize >= 0 && u.size != expectedSize {
+		return &verifyError{fmt.Sprintf("Size mismatch: expected %d, got %d", expectedSize, u.size)}
+	}
+	actual := map[string]string{"SHA-256": u.SHA256(), "SHA-512": u.SHA512()}
+	for algorithm, expected := range pushr.ParseDigest(digest) {
+		if actual[algorithm] == "" {
+			continue
+		}
+		if actual[algorithm] != expected {
+			return &verifyError{fmt.Sprintf("Checksum mismatch (%s): expected %s, got %s", algorithm, expected, actual[algorithm])}
+		}
+	}
+	return nil
+}
+
+func (u *stagedUpload) SHA256() string {
+	return hex.EncodeToString(u.sha256.Sum(nil))
+}
+
+func (u *stagedUpload) SHA512() string {
+	if u.sha512 == nil {
+		return ""
+	}
+	return hex.EncodeToString(u.sha512.Sum(nil))
+}
+
+// remove discards the staged file, it is a no-op after the file was moved into the storage.
+func (u *stagedUpload) remove() {
+	u.file.Close()
+	os.Remove(u.file.Name())
+}
+
+// store moves the staged file into the storage under name.
+func (u *stagedUpload) store(storage Storage, name string) error {
+	if err := u.file.Close(); err != nil {
+		return err
+	}
+	if m, ok := storage.(fileMover); ok {
+		if err := m.Move(name, u.file.Name()); err == nil {
+			return nil
+		}
+		// Fall through, e.g. if the staging dir is on another device
+	}
+	f, err := os.Open(u.file.Name())
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = storage.Put(name, f)
+	return err
+}
+
+// newUploadVersion builds the metadata of a verified staged upload.
+func newUploadVersion(filename string, u *stagedUpload) *pushr.Version {
+	version := pushr.NewVersion()
+	version.Filename = filename
+	version.ContentType = mime.TypeByExtension(filepath.Ext(filename))
+	version.Size = u.size
+	version.SHA256 = u.SHA256()
+	version.SHA512 = u.SHA512()
+	version.Uploaded = time.Now().UTC()
+	version.Signature = u.signature
+	return version
+}
+
+// validSignature reports whether s is empty or has the format of a base64 encoded Ed25519 signature.
+// The server does not know the signing keys, signatures are verified by the clients.
+func validSignature(s string) bool {
+	if s == "" {
+		return true
+	}
+	b, err := base64.StdEncoding.DecodeString(s)
+	return err == nil && len(b) == ed25519.SignatureSize
+}
+
+// cleanStagingDir creates the staging directory and removes uploads orphaned by a crash.
+func cleanStagingDir(stagingDir string) error {
+	if err := os.MkdirAll(stagingDir, 0700); err != nil {
+		return err
+	}
+	files, err := ioutil.ReadDir(stagingDir)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		log.Printf("Removing orphaned staging file %s\n", f.Name())
+		if err := os.RemoveAll(filepath.Join(stagingDir, f.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInterruptedUpload(t *testing.T) {
+	a, ts, cleanup := newTestServer(t)
+	defer cleanup()
+
+	// Announce 100 bytes but drop the connection after 10
+	conn, err := net.Dial("tcp", strings.TrimPrefix(ts.URL, "http://"))
+	if err != nil {
+		t.Fatalf("Could not connect: %s", err)
+	}
+	fmt.Fprint(conn, "POST /releases/test/1.0.0/test.zip HTTP/1.1\r\nHost: pushr\r\nContent-Type: application/octet-stream\r\nContent-Length: 100\r\n\r\n")
+	fmt.Fprint(conn, "TESTOUTPUT")
+	for i := 0; ; i++ {
+		a.ds.RLock()
+		reserved := a.ds.pending["test/1.0.0"]
+		a.ds.RUnlock()
+		if reserved {
+			break
+		}
+		if i > 1000 {
+			t.Fatal("Upload did not start")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	conn.Close()
+
+	// Wait for the server to discard the upload
+	for i := 0; ; i++ {
+		a.ds.RLock()
+		reserved := a.ds.pending["test/1.0.0"]
+		a.ds.RUnlock()
+		if !reserved {
+			break
+		}
+		if i > 1000 {
+			t.Fatal("Interrupted upload was not discarded")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	if _, found := a.ds.Version("test", "1.0.0"); found {
+		t.Error("Interrupted upload was committed")
+	}
+	if _, err := a.ds.storage.Stat("test/1.0.0/test-1.0.0.zip"); !os.IsNotExist(err) {
+		t.Errorf("Interrupted upload was stored: %v", err)
+	}
+	if files, _ := ioutil.ReadDir(a.stagingDir); len(files) != 0 {
+		t.Errorf("Staging files left after interrupted upload: %d", len(files))
+	}
+
+	// The version can be uploaded again
+	if resp := upload(t, ts.URL+"/releases/test/1.0.0/test.zip", strings.NewReader("TESTOUTPUT")); resp.StatusCode != http.StatusCreated {
+		t.Errorf("Upload after interrupted upload failed with status %d", resp.StatusCode)
+	}
+}
+
+func TestUploadDigestMismatch(t *testing.T) {
+	a, ts, cleanup := newTestServer(t)
+	defer cleanup()
+
+	req, _ := http.NewRequest("POST", ts.URL+"/releases/test/1.0.0/test.zip", strings.NewReader("TESTOUTPUT"))
+	req.Header.Set("Digest", "SHA-256=47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU=") // Empty input
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Upload failed: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Upload with wrong digest returned %d, expected 400", resp.StatusCode)
+	}
+	if _, found := a.ds.Version("test", "1.0.0"); found {
+		t.Error("Upload with wrong digest was committed")
+	}
+	if _, err := a.ds.storage.Stat("test/1.0.0/test-1.0.0.zip"); !os.IsNotExist(err) {
+		t.Errorf("Upload with wrong digest was stored: %v", err)
+	}
+}
+
+func TestCleanStagingDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pushrtest")
+	if err != nil {
+		t.Fatalf("Could not create test dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	stagingDir := filepath.Join(dir, ".staging")
+	if err := cleanStagingDir(stagingDir); err != nil {
+		t.Fatalf("Could not create staging dir: %s", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(stagingDir, "upload-123"), []byte("TRUNC"), 0600); err != nil {
+		t.Fatalf("Could not write orphaned file: %s", err)
+	}
+	if err := cleanStagingDir(stagingDir); err != nil {
+		t.Fatalf("Could not clean staging dir: %s", err)
+	}
+	if files, _ := ioutil.ReadDir(stagingDir); len(files) != 0 {
+		t.Errorf("Orphaned staging files left: %d", len(files))
+	}
+}
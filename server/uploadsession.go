@@ -0,0 +1,356 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/blang/pushr"
+	"github.com/blang/semver"
+	"github.com/gorilla/mux"
+	"io"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Default time after which an idle upload session is removed
+const defaultUploadExpiry = 24 * time.Hour
+
+// uploadSession is a resumable upload, written in chunks and committed once complete.
+// The version or artifact stays reserved for the lifetime of the session,
+// unless a session for a different file of the same version or artifact replaces it.
+type uploadSession struct {
+	sync.Mutex
+	pushr.UploadSession
+	upload       *stagedUpload
+	artifactKey  string
+	lastActivity time.Time
+	closed       bool // Set once the session is completed, aborted or expired
+}
+
+type uploadSessions struct {
+	sync.Mutex
+	sessions map[string]*uploadSession
+	expiry   time.Duration
+}
+
+func newUploadSessions() *uploadSessions {
+	return &uploadSessions{
+		sessions: make(map[string]*uploadSession),
+		expiry:   defaultUploadExpiry,
+	}
+}
+
+func (s *uploadSessions) get(id string) (*uploadSession, bool) {
+	s.Lock()
+	defer s.Unlock()
+	session, found := s.sessions[id]
+	return session, found
+}
+
+// find returns a running session with the same target, file name, notes, size, digest and signature.
+// Sessions without digest are never matched, the content could differ.
+func (s *uploadSessions) find(req *pushr.UploadSession, artifactKey string) (*uploadSession, bool) {
+	if req.Digest == "" {
+		return nil, false
+	}
+	s.Lock()
+	defer s.Unlock()
+	for _, session := range s.sessions {
+		if session.Release == req.Release && session.Version == req.Version && session.artifactKey == artifactKey &&
+			session.Filename == req.Filename && session.Notes == req.Notes &&
+			session.Size == req.Size && session.Digest == req.Digest && session.Signature == req.Signature {
+			return session, true
+		}
+	}
+	return nil, false
+}
+
+// target returns the running sessions uploading the same version or artifact as req.
+func (s *uploadSessions) target(req *pushr.UploadSession, artifactKey string) []*uploadSession {
+	s.Lock()
+	defer s.Unlock()
+	var sessions []*uploadSession
+	for _, session := range s.sessions {
+		if session.Release == req.Release && session.Version == req.Version && session.artifactKey == artifactKey {
+			sessions = append(sessions, session)
+		}
+	}
+	return sessions
+}
+
+func (s *uploadSessions) remove(id string) {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.sessions, id)
+}
+
+// closeSession discards the staged file and releases the reservation.
+// The caller must hold the session lock.
+func (a *RestAPI) closeSession(session *uploadSession) {
+	a.sessions.remove(session.ID)
+	if session.closed {
+		return
+	}
+	session.closed = true
+	session.upload.remove()
+	a.ds.unreserve(session.Release, session.Version, session.artifactKey)
+}
+
+// expireUploadSessions removes all sessions idle since longer than the expiry.
+func (a *RestAPI) expireUploadSessions(now time.Time) {
+	a.sessions.Lock()
+	var expired []*uploadSession
+	for _, session := range a.sessions.sessions {
+		if now.Sub(session.lastActivity) > a.sessions.expiry {
+			expired = append(expired, session)
+		}
+	}
+	a.sessions.Unlock()
+
+	for _, session := range expired {
+		session.Lock()
+		if now.Sub(session.lastActivity) > a.sessions.expiry {
+			log.Printf("Upload session %s of %s %s expired at offset %d\n", session.ID, session.Release, session.Version, session.upload.size)
+			a.closeSession(session)
+		}
+		session.Unlock()
+	}
+}
+
+// state returns the public state of the session.
+// The caller must hold the session lock.
+func (s *uploadSession) state(expiry time.Duration) *pushr.UploadSession {
+	state := s.UploadSession
+	state.Offset = s.upload.size
+	state.Expires = s.lastActivity.Add(expiry).UTC()
+	return &state
+}
+
+func newSessionID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// handleCreateUpload starts a resumable upload of a version or platform artifact.
+func (a *RestAPI) handleCreateUpload(w http.ResponseWriter, r *http.Request) {
+	var req pushr.UploadSession
+	if err := json.NewDecoder(io.LimitReader(r.Body, 64*1024)).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Error: %s", err)
+		return
+	}
+	if req.Release == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "Error: No release given")
+		return
+	}
+	if !a.authorize(w, r, pushr.ScopeWrite, req.Release) {
+		return
+	}
+	if _, err := semver.New(req.Version); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Error processing version: %s", err)
+		return
+	}
+	if filepath.Ext(req.Filename) == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Error: No File extension on %q found", req.Filename)
+		return
+	}
+	if req.Size <= 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "Error: No size given")
+		return
+	}
+	if !validSignature(req.Signature) {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "Error: Invalid signature")
+		return
+	}
+	artifactKey := ""
+	if req.Platform != nil {
+		if !validPlatform(*req.Platform) {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "Error: Invalid platform %q", req.Platform.Key())
+			return
+		}
+		artifactKey = req.Platform.Key()
+	}
+
+	// An interrupted upload of the same file continues the existing session
+	if session, found := a.sessions.find(&req, artifactKey); found {
+		session.Lock()
+		if !session.closed {
+			session.lastActivity = time.Now()
+			w.Header().Set("Location", "/uploads/"+session.ID)
+			w.Header().Set("Upload-Offset", strconv.FormatInt(session.upload.size, 10))
+			json.NewEncoder(w).Encode(session.state(a.sessions.expiry))
+			session.Unlock()
+			return
+		}
+		session.Unlock()
+	}
+	// A different file replaces the session of an earlier failed upload, which would hold the reservation until it expires
+	for _, session := range a.sessions.target(&req, artifactKey) {
+		session.Lock()
+		if !session.closed {
+			log.Printf("Upload session %s of %s %s replaced at offset %d\n", session.ID, session.Release, session.Version, session.upload.size)
+			a.closeSession(session)
+		}
+		session.Unlock()
+	}
+
+	id, err := newSessionID()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "Error: %s", err)
+		return
+	}
+	if !a.ds.reserve(req.Release, req.Version, artifactKey) {
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprintf(w, "Error: Version already found: %s", req.Version)
+		return
+	}
+	u, err := newStagedUpload(a.stagingDir, a.withSHA512)
+	if err != nil {
+		a.ds.unreserve(req.Release, req.Version, artifactKey)
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "Error: %s", err)
+		return
+	}
+	u.signature = req.Signature
+
+	req.ID = id
+	session := &uploadSession{
+		UploadSession: req,
+		upload:        u,
+		artifactKey:   artifactKey,
+		lastActivity:  time.Now(),
+	}
+	a.sessions.Lock()
+	a.sessions.sessions[id] = session
+	a.sessions.Unlock()
+
+	w.Header().Set("Location", "/uploads/"+id)
+	w.Header().Set("Upload-Offset", "0")
+	w.WriteHeader(http.StatusCreated)
+	session.Lock()
+	json.NewEncoder(w).Encode(session.state(a.sessions.expiry))
+	session.Unlock()
+}
+
+// session looks up the session of the request, checks the access to its release and locks it.
+// It returns false if there is no such session, the response is written in that case.
+func (a *RestAPI) session(w http.ResponseWriter, r *http.Request) (*uploadSession, bool) {
+	session, found := a.sessions.get(mux.Vars(r)["id"])
+	if !found {
+		w.WriteHeader(http.StatusNotFound)
+		return nil, false
+	}
+	if !a.authorize(w, r, pushr.ScopeWrite, session.Release) {
+		return nil, false
+	}
+	session.Lock()
+	if session.closed {
+		session.Unlock()
+		w.WriteHeader(http.StatusNotFound)
+		return nil, false
+	}
+	return session, true
+}
+
+func (a *RestAPI) handleGetUpload(w http.ResponseWriter, r *http.Request) {
+	session, ok := a.session(w, r)
+	if !ok {
+		return
+	}
+	defer session.Unlock()
+	w.Header().Set("Upload-Offset", strconv.FormatInt(session.upload.size, 10))
+	json.NewEncoder(w).Encode(session.state(a.sessions.expiry))
+}
+
+// handlePatchUpload appends a chunk at the offset given by the Upload-Offset header.
+// An interrupted chunk keeps everything received, the client resumes from the current offset.
+func (a *RestAPI) handlePatchUpload(w http.ResponseWriter, r *http.Request) {
+	session, ok := a.session(w, r)
+	if !ok {
+		return
+	}
+	defer session.Unlock()
+	session.lastActivity = time.Now()
+	defer func() {
+		session.lastActivity = time.Now()
+	}()
+
+	u := session.upload
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset != u.size {
+		w.Header().Set("Upload-Offset", strconv.FormatInt(u.size, 10))
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprintf(w, "Error: Offset mismatch, expected %d", u.size)
+		return
+	}
+
+	defer r.Body.Close()
+	remaining := session.Size - u.size
+	_, err = io.Copy(u, io.LimitReader(r.Body, remaining))
+	w.Header().Set("Upload-Offset", strconv.FormatInt(u.size, 10))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Error: %s", err)
+		return
+	}
+	if n, _ := r.Body.Read(make([]byte, 1)); n > 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Error: Chunk exceeds announced size of %d", session.Size)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleCompleteUpload verifies a fully transferred upload and commits it.
+func (a *RestAPI) handleCompleteUpload(w http.ResponseWriter, r *http.Request) {
+	session, ok := a.session(w, r)
+	if !ok {
+		return
+	}
+	defer session.Unlock()
+
+	u := session.upload
+	if u.size != session.Size {
+		w.Header().Set("Upload-Offset", strconv.FormatInt(u.size, 10))
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprintf(w, "Error: Upload incomplete, %d of %d bytes received", u.size, session.Size)
+		return
+	}
+	// The session is finished either way, a failed verification can not be fixed by more chunks
+	defer a.closeSession(session)
+	if err := u.finish(session.Size, session.Digest); err != nil {
+		if _, ok := err.(*verifyError); ok {
+			w.WriteHeader(http.StatusBadRequest)
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		fmt.Fprintf(w, "Error: %s", err)
+		return
+	}
+	a.commitUpload(w, r, session.Release, session.Version, filepath.Ext(session.Filename), session.Platform, session.Notes, u)
+}
+
+func (a *RestAPI) handleAbortUpload(w http.ResponseWriter, r *http.Request) {
+	session, ok := a.session(w, r)
+	if !ok {
+		return
+	}
+	defer session.Unlock()
+	a.closeSession(session)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/blang/pushr"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUploadSession(t *testing.T) {
+	a, ts, cleanup := newTestServer(t)
+	defer cleanup()
+
+	content := strings.Repeat("0123456789", 100)
+	sum := sha256.Sum256([]byte(content))
+	digest := pushr.DigestHeader(hex.EncodeToString(sum[:]), "")
+	request := func(method string, url string, header map[string]string, body string) *http.Response {
+		req, _ := http.NewRequest(method, ts.URL+url, strings.NewReader(body))
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Request failed: %s", err)
+		}
+		return resp
+	}
+	create := func(session *pushr.UploadSession) (*pushr.UploadSession, int) {
+		b, _ := json.Marshal(session)
+		resp := request("POST", "/uploads", nil, string(b))
+		defer resp.Body.Close()
+		var created pushr.UploadSession
+		json.NewDecoder(resp.Body).Decode(&created)
+		return &created, resp.StatusCode
+	}
+
+	session, code := create(&pushr.UploadSession{Release: "test", Version: "1.0.0", Filename: "test.zip", Size: int64(len(content)), Digest: digest})
+	if code != http.StatusCreated || session.ID == "" || session.Expires.IsZero() {
+		t.Fatalf("Create session failed with status %d: %v", code, session)
+	}
+	if resp := upload(t, ts.URL+"/releases/test/1.0.0/test.zip", strings.NewReader(content)); resp.StatusCode != http.StatusConflict {
+		t.Errorf("Upload of version reserved by session returned %d, expected 409", resp.StatusCode)
+	}
+
+	// Chunks must continue at the current offset
+	if resp := request("PATCH", "/uploads/"+session.ID, map[string]string{"Upload-Offset": "0"}, content[:300]); resp.StatusCode != http.StatusNoContent || resp.Header.Get("Upload-Offset") != "300" {
+		t.Fatalf("Patch failed with status %d", resp.StatusCode)
+	}
+	if resp := request("PATCH", "/uploads/"+session.ID, map[string]string{"Upload-Offset": "0"}, content[:300]); resp.StatusCode != http.StatusConflict || resp.Header.Get("Upload-Offset") != "300" {
+		t.Errorf("Patch at wrong offset returned %d", resp.StatusCode)
+	}
+	if resp := request("POST", "/uploads/"+session.ID+"/complete", nil, ""); resp.StatusCode != http.StatusConflict {
+		t.Errorf("Completing incomplete upload returned %d", resp.StatusCode)
+	}
+
+	// Creating the same upload again continues the session
+	resumed, code := create(&pushr.UploadSession{Release: "test", Version: "1.0.0", Filename: "test.zip", Size: int64(len(content)), Digest: digest})
+	if code != http.StatusOK || resumed.ID != session.ID || resumed.Offset != 300 {
+		t.Errorf("Session not continued: %d %v", code, resumed)
+	}
+
+	if resp := request("PATCH", "/uploads/"+session.ID, map[string]string{"Upload-Offset": "300"}, content[300:]+"TOOLONG"); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Patch exceeding size returned %d", resp.StatusCode)
+	}
+	if resp := request("HEAD", "/uploads/"+session.ID, nil, ""); resp.StatusCode != http.StatusOK || resp.Header.Get("Upload-Offset") != "1000" {
+		t.Errorf("Wrong offset: %d %s", resp.StatusCode, resp.Header.Get("Upload-Offset"))
+	}
+	if resp := request("POST", "/uploads/"+session.ID+"/complete", nil, ""); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Complete failed with status %d", resp.StatusCode)
+	}
+	if v, found := a.ds.Version("test", "1.0.0"); !found || v.SHA256 != hex.EncodeToString(sum[:]) {
+		t.Errorf("Upload not committed: %v", v)
+	}
+	if resp := request("GET", "/uploads/"+session.ID, nil, ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Completed session still found: %d", resp.StatusCode)
+	}
+	if len(a.ds.pending) != 0 {
+		t.Errorf("Reservations left after upload: %v", a.ds.pending)
+	}
+
+	// Verification failure
+	session, _ = create(&pushr.UploadSession{Release: "test", Version: "1.1.0", Filename: "test.zip", Size: 5, Digest: digest})
+	request("PATCH", "/uploads/"+session.ID, map[string]string{"Upload-Offset": "0"}, "OTHER")
+	if resp := request("POST", "/uploads/"+session.ID+"/complete", nil, ""); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Complete of corrupt upload returned %d", resp.StatusCode)
+	}
+	if _, found := a.ds.Version("test", "1.1.0"); found {
+		t.Error("Corrupt upload committed")
+	}
+
+	// A different file replaces the session of the same version instead of waiting for its expiry
+	session, _ = create(&pushr.UploadSession{Release: "test", Version: "1.1.0", Filename: "test.zip", Size: 5, Digest: digest})
+	for _, other := range []*pushr.UploadSession{
+		{Release: "test", Version: "1.1.0", Filename: "test.zip", Size: 5, Digest: digest, Notes: "Changed"},
+		{Release: "test", Version: "1.1.0", Filename: "test.tar.gz", Size: 5, Digest: digest},
+		{Release: "test", Version: "1.1.0", Filename: "test.zip", Size: 5, Digest: "sha-256=other"},
+	} {
+		replacing, code := create(other)
+		if code != http.StatusCreated || replacing.ID == session.ID {
+			t.Errorf("Session %v not replaced: %d %v", other, code, replacing)
+		}
+		if resp := request("HEAD", "/uploads/"+session.ID, nil, ""); resp.StatusCode != http.StatusNotFound {
+			t.Errorf("Replaced session still found: %d", resp.StatusCode)
+		}
+		session = replacing
+	}
+	request("DELETE", "/uploads/"+session.ID, nil, "")
+	if len(a.ds.pending) != 0 {
+		t.Errorf("Reservations left after abort: %v", a.ds.pending)
+	}
+
+	// Expiry releases the reservation
+	session, _ = create(&pushr.UploadSession{Release: "test", Version: "1.2.0", Filename: "test.zip", Platform: &pushr.Platform{OS: "linux", Arch: "amd64"}, Size: 5})
+	a.expireUploadSessions(time.Now().Add(defaultUploadExpiry - time.Minute))
+	if resp := request("HEAD", "/uploads/"+session.ID, nil, ""); resp.StatusCode != http.StatusOK {
+		t.Errorf("Session expired too early: %d", resp.StatusCode)
+	}
+	a.expireUploadSessions(time.Now().Add(defaultUploadExpiry + time.Minute))
+	if resp := request("HEAD", "/uploads/"+session.ID, nil, ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expired session still found: %d", resp.StatusCode)
+	}
+	if len(a.ds.pending) != 0 {
+		t.Errorf("Reservations left after expiry: %v", a.ds.pending)
+	}
+	if files, _ := ioutil.ReadDir(a.stagingDir); len(files) != 0 {
+		t.Errorf("Staging files left: %d", len(files))
+	}
+
+	for _, invalid := range []*pushr.UploadSession{
+		{Release: "test", Version: "invalid", Filename: "test.zip", Size: 5},
+		{Release: "test", Version: "1.3.0", Filename: "test", Size: 5},
+		{Release: "test", Version: "1.3.0", Filename: "test.zip"},
+		{Release: "test", Version: "1.3.0", Filename: "test.zip", Size: 5, Platform: &pushr.Platform{OS: "linux"}},
+	} {
+		if _, code := create(invalid); code != http.StatusBadRequest {
+			t.Errorf("Invalid session %v returned %d", invalid, code)
+		}
+	}
+}
+
+func TestChunkedUploadClient(t *testing.T) {
+	a, ts, cleanup := newTestServer(t)
+	defer cleanup()
+
+	content := bytes.Repeat([]byte("0123456789"), 1000)
+	c := pushr.NewClient(ts.URL, "", "", pushr.WithChunkedUpload(1000, 3000))
+	if err := c.UploadPlatform("test", "1.0.0", pushr.Platform{OS: "linux", Arch: "amd64"}, "test.zip", bytes.NewReader(content)); err != nil {
+		t.Fatalf("Chunked upload failed: %s", err)
+	}
+	v, found := a.ds.Version("test", "1.0.0")
+	if !found || v.Artifacts["linux/amd64"] == nil || v.Artifacts["linux/amd64"].Size != int64(len(content)) {
+		t.Fatalf("Chunked upload not committed: %v", v)
+	}
+	if len(a.sessions.sessions) != 0 {
+		t.Errorf("Sessions left after upload: %d", len(a.sessions.sessions))
+	}
+
+	// Small uploads use a single request
+	if err := c.Upload("test", "1.0.0", "test.zip", strings.NewReader("SMALL")); err != nil {
+		t.Fatalf("Upload failed: %s", err)
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/blang/pushr"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"sync"
+	"time"
+)
+
+const (
+	// Number of attempts to deliver an event to a webhook
+	maxWebhookAttempts = 5
+
+	// Number of deliveries kept in the delivery log
+	maxWebhookDeliveries = 1000
+)
+
+var validEvents = map[string]bool{
+	pushr.EventUpload:    true,
+	pushr.EventDelete:    true,
+	pushr.EventYank:      true,
+	pushr.EventUnyank:    true,
+	pushr.EventPromote:   true,
+	pushr.EventUnpromote: true,
+}
+
+// webhook is a receiver of release events, as configured in the webhook file.
+type webhook struct {
+	URL      string   `json:"url"`
+	Secret   string   `json:"secret"`             // Key of the HMAC signature of the body
+	Releases []string `json:"releases,omitempty"` // Release name patterns as understood by path.Match, all releases if empty
+	Events   []string `json:"events,omitempty"`   // All events if empty
+}
+
+// matches reports whether the webhook receives event.
+func (h *webhook) matches(event *pushr.Event) bool {
+	if len(h.Events) > 0 {
+		found := false
+		for _, e := range h.Events {
+			if e == event.Type {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(h.Releases) == 0 {
+		return true
+	}
+	for _, pattern := range h.Releases {
+		if matched, _ := path.Match(pattern, event.Release); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// host returns the host of the webhook URL for the server log.
+// Webhook URLs may contain a secret in their path or query, e.g. those of chat services.
+func (h *webhook) host() string {
+	if u, err := url.Parse(h.URL); err == nil {
+		return u.Host
+	}
+	return "invalid URL"
+}
+
+// webhookDelivery is an entry of the delivery log, one per attempt.
+type webhookDelivery struct {
+	Event    string    `json:"event"` // Event ID
+	Type     string    `json:"type"`
+	Release  string    `json:"release"`
+	Version  string    `json:"version"`
+	URL      string    `json:"url"`
+	Attempt  int       `json:"attempt"`
+	Status   int       `json:"status,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	Time     time.Time `json:"time"`
+	Duration float64   `json:"duration_ms"`
+}
+
+// webhooks delivers events to the configured webhooks in the background, retrying with exponential backoff.
+type webhooks struct {
+	hooks      []*webhook
+	client     *http.Client
+	retryDelay time.Duration // Delay before the first retry, doubled on every attempt
+
+	ctx    context.Context // Canceled on close, aborting retries
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu         sync.Mutex
+	deliveries []*webhookDelivery // Oldest first
+}
+
+func newWebhooks(hooks []*webhook) *webhooks {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &webhooks{
+		hooks:      hooks,
+		client:     &http.Client{Timeout: 30 * time.Second},
+		retryDelay: time.Second,
+		ctx:        ctx,
+		cancel:     cancel,
+	}
+}
+
+// loadWebhooks reads the webhook configuration, a JSON list of webhooks.
+func loadWebhooks(file string) ([]*webhook, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var hooks []*webhook
+	if err := json.Unmarshal(b, &hooks); err != nil {
+		return nil, fmt.Errorf("Could not read webhooks %s: %s", file, err)
+	}
+	// Webhooks are referred to by index, their URLs must not end up in the log
+	for i, h := range hooks {
+		if u, err := url.Parse(h.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return nil, fmt.Errorf("Invalid URL of webhook %d", i)
+		}
+		for _, e := range h.Events {
+			if !validEvents[e] {
+				return nil, fmt.Errorf("Invalid event %q of webhook %d", e, i)
+			}
+		}
+		for _, pattern := range h.Releases {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("Invalid release pattern %q of webhook %d", pattern, i)
+			}
+		}
+	}
+	return hooks, nil
+}
+
+// publish sends event to all matching webhooks without waiting for the delivery.
+func (wh *webhooks) publish(event *pushr.Event) {
+	var body []byte
+	for _, h := range wh.hooks {
+		if !h.matches(event) {
+			continue
+		}
+		if body == nil {
+			var err error
+			if body, err = json.Marshal(event); err != nil {
+				log.Printf("Could not encode event %s: %s\n", event.ID, err)
+				return
+			}
+		}
+		wh.wg.Add(1)
+		go func(h *webhook) {
+			defer wh.wg.Done()
+			wh.deliver(h, event, body)
+		}(h)
+	}
+}
+
+// deliver sends body to the webhook until it is accepted, the attempts are exhausted or the webhooks are closed.
+// Network errors, 429 and 5xx responses are retried, other responses are final.
+func (wh *webhooks) deliver(h *webhook, event *pushr.Event, body []byte) {
+	delay := wh.retryDelay
+	for attempt := 1; attempt <= maxWebhookAttempts; attempt++ {
+		if attempt > 1 {
+			select {
+			case <-wh.ctx.Done():
+				log.Printf("Delivery of event %s to %s aborted after %d attempts\n", event.ID, h.host(), attempt-1)
+				return
+			case <-time.After(delay):
+			}
+			delay *= 2
+		}
+		status, err := wh.send(h, event, body, attempt)
+		if err == nil && status < 300 {
+			return
+		}
+		if err == nil && status != http.StatusTooManyRequests && status < 500 {
+			return
+		}
+	}
+	log.Printf("Delivery of event %s to %s failed after %d attempts\n", event.ID, h.host(), maxWebhookAttempts)
+}
+
+func (wh *webhooks) send(h *webhook, event *pushr.Event, body []byte, attempt int) (int, error) {
+	d := &webhookDelivery{
+		Event:   event.ID,
+		Type:    event.Type,
+		Release: event.Release,
+		Version: event.Version,
+		URL:     h.URL,
+		Attempt: attempt,
+		Time:    time.Now().UTC(),
+	}
+	defer func() {
+		d.Duration = float64(time.Since(d.Time).Microseconds()) / 1000
+		wh.record(d)
+	}()
+	req, err := http.NewRequest("POST", h.URL, bytes.NewReader(body))
+	if err != nil {
+		d.Error = err.Error()
+		return 0, err
+	}
+	req = req.WithContext(wh.ctx)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "pushr-webhook")
+	req.Header.Set(pushr.WebhookEventHeader, event.Type)
+	req.Header.Set(pushr.WebhookDeliveryHeader, event.ID)
+	if h.Secret != "" {
+		req.Header.Set(pushr.WebhookSignatureHeader, pushr.SignWebhook(h.Secret, body))
+	}
+	resp, err := wh.client.Do(req)
+	if err != nil {
+		d.Error = err.Error()
+		return 0, err
+	}
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64*1024))
+	resp.Body.Close()
+	d.Status = resp.StatusCode
+	return resp.StatusCode, nil
+}
+
+func (wh *webhooks) record(d *webhookDelivery) {
+	wh.mu.Lock()
+	defer wh.mu.Unlock()
+	wh.deliveries = append(wh.deliveries, d)
+	if len(wh.deliveries) > maxWebhookDeliveries {
+		wh.deliveries = append([]*webhookDelivery(nil), wh.deliveries[len(wh.deliveries)-maxWebhookDeliveries:]...)
+	}
+}
+
+// close aborts pending retries and waits for running deliveries.
+func (wh *webhooks) close() {
+	wh.cancel()
+	wh.wg.Wait()
+}
+
+// publish assigns an ID and the time to event and notifies the webhooks and event streams.
+func (a *RestAPI) publish(event *pushr.Event) {
+	id, err := newSessionID()
+	if err != nil {
+		log.Printf("Could not create event ID: %s\n", err)
+		return
+	}
+	event.ID = id
+	event.Time = time.Now().UTC()
+	a.webhooks.publish(event)
+	a.events.broadcast(event)
+}
+
+// handleWebhookDeliveries lists the delivery log, newest first.
+func (a *RestAPI) handleWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	a.webhooks.mu.Lock()
+	deliveries := make([]*webhookDelivery, 0, len(a.webhooks.deliveries))
+	for i := len(a.webhooks.deliveries) - 1; i >= 0; i-- {
+		deliveries = append(deliveries, a.webhooks.deliveries[i])
+	}
+	a.webhooks.mu.Unlock()
+	json.NewEncoder(w).Encode(deliveries)
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/blang/pushr"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhookReceiver records the events it receives, failing the first failures requests with 500.
+type webhookReceiver struct {
+	sync.Mutex
+	t        *testing.T
+	secret   string
+	failures int
+	requests int
+	events   []*pushr.Event
+}
+
+func (rcv *webhookReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	rcv.Lock()
+	defer rcv.Unlock()
+	rcv.requests++
+	if rcv.requests <= rcv.failures {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if !pushr.VerifyWebhook(rcv.secret, body, r.Header.Get(pushr.WebhookSignatureHeader)) {
+		rcv.t.Errorf("Invalid signature %q", r.Header.Get(pushr.WebhookSignatureHeader))
+	}
+	var event pushr.Event
+	if err := json.Unmarshal(body, &event); err != nil {
+		rcv.t.Errorf("Invalid event: %s", err)
+	}
+	if r.Header.Get(pushr.WebhookEventHeader) != event.Type || r.Header.Get(pushr.WebhookDeliveryHeader) != event.ID {
+		rcv.t.Errorf("Wrong headers %v of event %v", r.Header, event)
+	}
+	rcv.events = append(rcv.events, &event)
+}
+
+// waitEvents waits until n events were received and returns them by type and version.
+func (rcv *webhookReceiver) waitEvents(n int) map[string]*pushr.Event {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		rcv.Lock()
+		if len(rcv.events) >= n || time.Now().After(deadline) {
+			events := make(map[string]*pushr.Event)
+			for _, e := range rcv.events {
+				events[e.Type+" "+e.Version] = e
+			}
+			if len(rcv.events) != n {
+				rcv.t.Errorf("Expected %d events, got %d", n, len(rcv.events))
+			}
+			rcv.Unlock()
+			return events
+		}
+		rcv.Unlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWebhooks(t *testing.T) {
+	a, ts, cleanup := newTestServer(t)
+	defer cleanup()
+
+	all := &webhookReceiver{t: t, secret: "secret1"}
+	allServer := httptest.NewServer(all)
+	defer allServer.Close()
+	promotions := &webhookReceiver{t: t, secret: "secret2", failures: 2}
+	promotionsServer := httptest.NewServer(promotions)
+	defer promotionsServer.Close()
+	a.webhooks = newWebhooks([]*webhook{
+		{URL: allServer.URL, Secret: all.secret, Releases: []string{"te*"}},
+		{URL: promotionsServer.URL, Secret: promotions.secret, Events: []string{pushr.EventPromote}},
+	})
+	a.webhooks.retryDelay = time.Millisecond
+	defer a.webhooks.close()
+
+	for _, path := range []string{"test/0.9.0", "test/1.0.0", "other/1.0.0"} {
+		if resp := upload(t, ts.URL+"/releases/"+path+"/test.zip", strings.NewReader("TESTOUTPUT")); resp.StatusCode != http.StatusCreated {
+			t.Fatalf("Upload failed with status %d", resp.StatusCode)
+		}
+	}
+	if resp := upload(t, ts.URL+"/releases/test/1.0.0/linux/amd64/test.zip", strings.NewReader("TESTOUTPUT")); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Artifact upload failed with status %d", resp.StatusCode)
+	}
+	c := pushr.NewClient(ts.URL, "", "")
+	if err := c.Yank("test", "1.0.0"); err != nil {
+		t.Fatalf("Yank failed: %s", err)
+	}
+	if err := c.Unyank("test", "1.0.0"); err != nil {
+		t.Fatalf("Unyank failed: %s", err)
+	}
+	if err := c.Promote("test", "stable", "1.0.0"); err != nil {
+		t.Fatalf("Promote failed: %s", err)
+	}
+	if err := c.Delete("test", "0.9.0"); err != nil {
+		t.Fatalf("Delete failed: %s", err)
+	}
+
+	// Three uploads of release test, the one of release other is filtered
+	events := all.waitEvents(7)
+	for _, key := range []string{"upload 0.9.0", "upload 1.0.0", "yank 1.0.0", "unyank 1.0.0", "promote 1.0.0", "delete 0.9.0"} {
+		e := events[key]
+		if e == nil {
+			t.Errorf("Missing %s event", key)
+			continue
+		}
+		if e.Release != "test" || e.Metadata == nil || e.Metadata.SHA256 == "" || e.ID == "" || e.Time.IsZero() {
+			t.Errorf("Wrong %s event: %v", key, e)
+		}
+	}
+	if e := events["yank 1.0.0"]; e != nil && !e.Metadata.Yanked {
+		t.Errorf("Yank event does not contain the yanked version: %v", e.Metadata)
+	}
+	if e := events["promote 1.0.0"]; e != nil && e.Channel != "stable" {
+		t.Errorf("Wrong channel of promote event: %s", e.Channel)
+	}
+
+	// Promotions are delivered on the third attempt
+	if events := promotions.waitEvents(1); events["promote 1.0.0"] == nil {
+		t.Errorf("Missing promote event: %v", events)
+	}
+	resp, err := http.Get(ts.URL + "/webhooks/deliveries")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var deliveries []*webhookDelivery
+	json.NewDecoder(resp.Body).Decode(&deliveries)
+	resp.Body.Close()
+	var attempts []int
+	for _, d := range deliveries {
+		if d.URL == promotionsServer.URL {
+			attempts = append([]int{d.Status}, attempts...)
+		}
+	}
+	if len(attempts) != 3 || attempts[0] != 500 || attempts[1] != 500 || attempts[2] != 200 {
+		t.Errorf("Wrong delivery log of retried webhook: %v", attempts)
+	}
+}
+
+func TestLoadWebhooks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pushrtest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "webhooks.json")
+
+	for config, valid := range map[string]bool{
+		`[{"url": "https://example.com/hook", "secret": "s", "releases": ["app-*"], "events": ["upload", "promote"]}]`: true,
+		`[{"url": "ftp://example.com/hook"}]`:                        false,
+		`[{"url": "https://example.com/hook", "events": ["build"]}]`: false,
+		`[{"url": "https://example.com/hook", "releases": ["[a"]}]`:  false,
+		`{"url": "https://example.com/hook"}`:                        false,
+	} {
+		if err := ioutil.WriteFile(file, []byte(config), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if hooks, err := loadWebhooks(file); (err == nil) != valid {
+			t.Errorf("Config %s: expected valid %t, got %v", config, valid, err)
+		} else if valid && (len(hooks) != 1 || hooks[0].Releases[0] != "app-*") {
+			t.Errorf("Config %s: wrong webhooks %v", config, hooks)
+		}
+		if err != nil && strings.Contains(err.Error(), "example.com") {
+			t.Errorf("Config %s: error contains the URL: %s", config, err)
+		}
+	}
+}
+
+func TestWebhookLogHidesURL(t *testing.T) {
+	var out syncBuffer
+	log.SetOutput(&out)
+	defer log.SetOutput(os.Stderr)
+
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+	wh := newWebhooks([]*webhook{{URL: closed.URL + "/services/SECRET?token=SECRET"}})
+	wh.retryDelay = time.Millisecond
+	wh.publish(&pushr.Event{ID: "1", Type: pushr.EventUpload, Release: "test", Version: "1.0.0"})
+	wh.wg.Wait()
+	wh.close()
+	if !strings.Contains(out.String(), "failed after") || !strings.Contains(out.String(), strings.TrimPrefix(closed.URL, "http://")) {
+		t.Errorf("Failed delivery not logged: %s", out.String())
+	}
+	if strings.Contains(out.String(), "SECRET") {
+		t.Errorf("Webhook URL logged: %s", out.String())
+	}
+}
@@ -0,0 +1,101 @@
+package pushr
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"io"
+	"io/ioutil"
+)
+
+// SignatureHeader carries the base64 encoded detached signature of an uploaded or downloaded file.
+const SignatureHeader = "X-PUSHR-SIGNATURE"
+
+var (
+	ErrUnsigned         = errors.New("File is not signed")
+	ErrInvalidSignature = errors.New("Signature does not match any trusted key")
+)
+
+// Signatures are Ed25519ph (RFC 8032) signatures over the SHA-512 digest of the file,
+// so large files are signed and verified without holding them in memory.
+var signatureOptions = &ed25519.Options{Hash: crypto.SHA512}
+
+// Sign returns the base64 encoded signature of the content of r.
+func Sign(key ed25519.PrivateKey, r io.Reader) (string, error) {
+	h := sha512.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return signDigest(key, h.Sum(nil))
+}
+
+func signDigest(key ed25519.PrivateKey, digest []byte) (string, error) {
+	sig, err := key.Sign(nil, digest, signatureOptions)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(sig), nil
+}
+
+// VerifySignature checks the base64 encoded signature of a file with the given SHA-512 digest
+// against the trusted keys. It returns ErrUnsigned if signature is empty and
+// ErrInvalidSignature if no key verifies it.
+func VerifySignature(keys []ed25519.PublicKey, digest []byte, signature string) error {
+	if signature == "" {
+		return ErrUnsigned
+	}
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil || len(sig) != ed25519.SignatureSize {
+		return ErrInvalidSignature
+	}
+	for _, key := range keys {
+		if ed25519.VerifyWithOptions(key, digest, sig, signatureOptions) == nil {
+			return nil
+		}
+	}
+	return ErrInvalidSignature
+}
+
+// WithSigningKey signs all uploads with key.
+// Uploads from readers not implementing io.Seeker are buffered in memory to compute the signature.
+func WithSigningKey(key ed25519.PrivateKey) Option {
+	return func(c *Client) {
+		c.signingKey = key
+	}
+}
+
+// WithPublicKeys pins the keys trusted to sign releases.
+// Downloads fail with ErrUnsigned or ErrInvalidSignature unless the file is signed by one of the keys.
+func WithPublicKeys(keys ...ed25519.PublicKey) Option {
+	return func(c *Client) {
+		c.publicKeys = keys
+	}
+}
+
+// sign computes the signature of the upload of r with the signing key.
+// It returns a reader of the same content and its size, which is determined if it was unknown.
+func (c *Client) sign(r io.Reader, size int64) (io.Reader, int64, string, error) {
+	if rs, ok := r.(io.ReadSeeker); ok {
+		start, err := rs.Seek(0, io.SeekCurrent)
+		if err == nil {
+			h := sha512.New()
+			if _, err := io.Copy(h, rs); err != nil {
+				return nil, 0, "", err
+			}
+			if _, err := rs.Seek(start, io.SeekStart); err != nil {
+				return nil, 0, "", err
+			}
+			sig, err := signDigest(c.signingKey, h.Sum(nil))
+			return rs, size, sig, err
+		}
+	}
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, 0, "", err
+	}
+	sig, err := Sign(c.signingKey, bytes.NewReader(b))
+	return bytes.NewReader(b), int64(len(b)), sig, err
+}
@@ -0,0 +1,211 @@
+package pushr
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	// DefaultChunkThreshold is the minimum size of uploads using resumable upload sessions
+	DefaultChunkThreshold = 64 << 20
+
+	// DefaultChunkSize is the size of a chunk of a resumable upload
+	DefaultChunkSize = 8 << 20
+
+	// Number of attempts to resume a chunk before giving up
+	maxChunkAttempts = 5
+)
+
+// errSessionsUnsupported is returned by uploadChunked if the server does not know upload sessions.
+var errSessionsUnsupported = errors.New("Upload sessions not supported")
+
+// uploadChunked sends r through a resumable upload session.
+// Each chunk is buffered, so a failed chunk is resumed at the offset the server received.
+// If the server still has a session of an earlier failed upload of the same file, it is continued.
+func (c *Client) uploadChunked(ctx context.Context, target *UploadSession, r io.Reader, size int64, digest string) (err error) {
+	create := *target
+	create.Size = size
+	create.Digest = digest
+	session, err := c.createUploadSession(ctx, &create)
+	if err != nil {
+		return err
+	}
+	completed := false
+	defer func() {
+		// Sessions with digest are kept to be continued by a later upload of the same file if the failure
+		// is transient, others would keep the version reserved until they expire
+		if !completed && (digest == "" || !resumable(err)) {
+			c.abortUploadSession(session.ID)
+		}
+	}()
+
+	// Skip what the server received in an earlier attempt
+	offset := session.Offset
+	if offset > 0 {
+		if _, err := io.CopyN(ioutil.Discard, r, offset); err != nil {
+			return err
+		}
+	}
+	buf := make([]byte, c.chunkSize)
+	for offset < size {
+		n, err := io.ReadFull(r, buf)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			if offset+int64(n) != size {
+				return errors.New("Upload shorter than announced size")
+			}
+		} else if err != nil {
+			return err
+		}
+		if err := c.sendChunk(ctx, session.ID, offset, buf[:n]); err != nil {
+			return err
+		}
+		offset += int64(n)
+	}
+
+	req, err := c.newRequest(ctx, "POST", "/uploads/"+session.ID+"/complete", c.writeToken, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return newStatusError(resp)
+	}
+	completed = true
+	return nil
+}
+
+// sendChunk sends chunk starting at offset, resuming from the offset reported by the server on failure.
+func (c *Client) sendChunk(ctx context.Context, id string, offset int64, chunk []byte) error {
+	var err error
+	for attempt := 0; attempt < maxChunkAttempts; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(time.Duration(attempt) * c.retryDelay):
+			}
+			serverOffset, serr := c.uploadOffset(ctx, id)
+			if serr != nil {
+				err = serr
+				continue
+			}
+			if serverOffset < offset || serverOffset > offset+int64(len(chunk)) {
+				return errors.New("Upload session lost data")
+			}
+			chunk = chunk[serverOffset-offset:]
+			offset = serverOffset
+			if len(chunk) == 0 {
+				return nil
+			}
+		}
+		err = c.patchChunk(ctx, id, offset, chunk)
+		if err == nil || ctx.Err() != nil {
+			return err
+		}
+		var statusErr *StatusError
+		if errors.As(err, &statusErr) && statusErr.StatusCode != http.StatusConflict && statusErr.StatusCode < 500 {
+			// Not recoverable by resuming
+			return err
+		}
+	}
+	return err
+}
+
+func (c *Client) patchChunk(ctx context.Context, id string, offset int64, chunk []byte) error {
+	req, err := c.newRequest(ctx, "PATCH", "/uploads/"+id, c.writeToken, bytes.NewReader(chunk))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		return newStatusError(resp)
+	}
+	return nil
+}
+
+func (c *Client) uploadOffset(ctx context.Context, id string) (int64, error) {
+	req, err := c.newRequest(ctx, "HEAD", "/uploads/"+id, c.writeToken, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, newStatusError(resp)
+	}
+	return strconv.ParseInt(resp.Header.Get("Upload-Offset"), 10, 64)
+}
+
+func (c *Client) createUploadSession(ctx context.Context, session *UploadSession) (*UploadSession, error) {
+	b, err := json.Marshal(session)
+	if err != nil {
+		return nil, err
+	}
+	req, err := c.newRequest(ctx, "POST", "/uploads", c.writeToken, bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusCreated, http.StatusOK:
+	case http.StatusNotFound, http.StatusMethodNotAllowed:
+		// Older server, the upload was not started yet and can fall back to a single request
+		return nil, errSessionsUnsupported
+	default:
+		return nil, newStatusError(resp)
+	}
+	var created UploadSession
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil {
+		return nil, err
+	}
+	return &created, nil
+}
+
+// resumable reports whether a failed upload can be continued later, as the connection or the server failed.
+func resumable(err error) bool {
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode >= 500
+	}
+	var urlErr *url.Error
+	return errors.As(err, &urlErr) || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// abortUploadSession removes a failed session to release the reservation of the version on the server.
+func (c *Client) abortUploadSession(id string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, err := c.newRequest(ctx, "DELETE", "/uploads/"+id, c.writeToken, nil)
+	if err != nil {
+		return
+	}
+	if resp, err := c.httpClient.Do(req); err == nil {
+		resp.Body.Close()
+	}
+}
@@ -0,0 +1,118 @@
+package pushr
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Maximum delay between reconnection attempts of a watch
+const maxWatchDelay = time.Minute
+
+// Watch returns a channel receiving the latest version of release in channel as events of type EventLatest,
+// first the current one and then every change. The server pushes changes over a Server-Sent Events stream,
+// which is reconnected automatically with backoff until ctx is done. The returned channel is closed then.
+// An error is returned if the first connection fails.
+func (c *Client) Watch(ctx context.Context, release string, channel string) (<-chan *Event, error) {
+	resp, err := c.openEvents(ctx, release, channel)
+	if err != nil {
+		return nil, err
+	}
+	events := make(chan *Event)
+	go c.watch(ctx, resp, release, channel, events)
+	return events, nil
+}
+
+func (c *Client) watch(ctx context.Context, resp *http.Response, release string, channel string, events chan<- *Event) {
+	defer close(events)
+	latest := ""
+	delay := c.retryDelay
+	for {
+		if resp != nil {
+			delay = c.retryDelay
+			// A reconnected stream starts with the current latest version, which was already sent if unchanged
+			readEvents(resp.Body, func(event *Event) bool {
+				if event.Type != EventLatest || event.Version == latest {
+					return true
+				}
+				select {
+				case events <- event:
+					latest = event.Version
+					return true
+				case <-ctx.Done():
+					return false
+				}
+			})
+			resp.Body.Close()
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		var err error
+		if resp, err = c.openEvents(ctx, release, channel); err != nil {
+			resp = nil
+			if delay *= 2; delay > maxWatchDelay {
+				delay = maxWatchDelay
+			}
+		}
+	}
+}
+
+// openEvents connects to the event stream of the latest version of release in channel.
+func (c *Client) openEvents(ctx context.Context, release string, channel string) (*http.Response, error) {
+	req, err := c.newRequest(ctx, "GET", "/releases/"+release+"/events?channel="+url.QueryEscape(channel), c.readToken, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, newStatusError(resp)
+	}
+	return resp, nil
+}
+
+// readEvents decodes the release events of a Server-Sent Events stream and passes them to handle
+// until r ends or handle returns false.
+func readEvents(r io.Reader, handle func(*Event) bool) error {
+	br := bufio.NewReader(r)
+	var data []byte
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			// Blank lines end an event, other fields than data and comments are not needed
+			if len(data) == 0 {
+				continue
+			}
+			var event Event
+			if err := json.Unmarshal(data, &event); err != nil {
+				return err
+			}
+			data = data[:0]
+			if !handle(&event) {
+				return nil
+			}
+		} else if strings.HasPrefix(line, "data:") {
+			if len(data) > 0 {
+				data = append(data, '\n')
+			}
+			data = append(data, strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " ")...)
+		}
+	}
+}
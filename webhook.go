@@ -0,0 +1,31 @@
+package pushr
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+)
+
+// Headers of webhook requests
+const (
+	WebhookEventHeader     = "X-PUSHR-EVENT"
+	WebhookDeliveryHeader  = "X-PUSHR-DELIVERY"
+	WebhookSignatureHeader = "X-PUSHR-WEBHOOK-SIGNATURE"
+)
+
+// SignWebhook returns the value of the signature header of a webhook body: sha256= followed by
+// the hex encoded HMAC-SHA256 of body with secret.
+func SignWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyWebhook reports whether signature is the valid signature header of a webhook body.
+func VerifyWebhook(secret string, body []byte, signature string) bool {
+	if !strings.HasPrefix(signature, "sha256=") {
+		return false
+	}
+	return hmac.Equal([]byte(signature), []byte(SignWebhook(secret, body)))
+}